@@ -0,0 +1,90 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// dkgRoundData memoizes the DKG master public keys and complaints fetched
+// from Governance for a single round.
+type dkgRoundData struct {
+	mpks         map[types.NodeID]*types.DKGMasterPublicKey
+	complaints   []*types.DKGComplaint
+	disqualified map[types.NodeID]struct{}
+}
+
+// GetMPK returns the DKG master public key proposed by nodeID for the given
+// round, fetching and caching the round's DKG data from Governance on the
+// first access.
+func (cache *NodeSetCache) GetMPK(
+	round uint64, nodeID types.NodeID) (*types.DKGMasterPublicKey, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	data := cache.getOrUpdateDKGDataNoLock(round)
+	mpk, exists := data.mpks[nodeID]
+	return mpk, exists
+}
+
+// GetQualifiedNodes returns the node IDs that proposed a master public key
+// for the given round and were not disqualified by a complaint.
+func (cache *NodeSetCache) GetQualifiedNodes(
+	round uint64) map[types.NodeID]struct{} {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	data := cache.getOrUpdateDKGDataNoLock(round)
+	qualified := make(map[types.NodeID]struct{}, len(data.mpks))
+	for nID := range data.mpks {
+		if _, disqualified := data.disqualified[nID]; disqualified {
+			continue
+		}
+		qualified[nID] = struct{}{}
+	}
+	return qualified
+}
+
+// Touch forces the next GetMPK/GetQualifiedNodes call for this round to
+// refetch from Governance. Callers should invoke this when they observe a
+// new complaint or master public key arriving mid-round, since those
+// wouldn't otherwise invalidate an already-cached round.
+func (cache *NodeSetCache) Touch(round uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	delete(cache.dkgData, round)
+}
+
+// getOrUpdateDKGDataNoLock fetches (or returns cached) DKG master public
+// keys and complaints for a round. The caller must hold cache.lock.
+func (cache *NodeSetCache) getOrUpdateDKGDataNoLock(round uint64) *dkgRoundData {
+	if data, exists := cache.dkgData[round]; exists {
+		return data
+	}
+	data := &dkgRoundData{
+		mpks:         make(map[types.NodeID]*types.DKGMasterPublicKey),
+		complaints:   cache.gov.DKGComplaints(round),
+		disqualified: make(map[types.NodeID]struct{}),
+	}
+	for _, mpk := range cache.gov.DKGMasterPublicKeys(round) {
+		data.mpks[mpk.ProposerID] = mpk
+	}
+	for _, complaint := range data.complaints {
+		data.disqualified[complaint.PrivateShare.ProposerID] = struct{}{}
+	}
+	cache.dkgData[round] = data
+	return data
+}
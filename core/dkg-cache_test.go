@@ -0,0 +1,110 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/dexon-foundation/dexon-consensus/core/test"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+	"github.com/stretchr/testify/suite"
+)
+
+// testDKGGov extends testGov with DKG master public keys/complaints that a
+// test can populate directly, instead of the random ones testGov itself
+// would hand out for the node-set endpoints.
+type testDKGGov struct {
+	testGov
+	mpks       []*types.DKGMasterPublicKey
+	complaints []*types.DKGComplaint
+}
+
+func (g *testDKGGov) DKGMasterPublicKeys(
+	round uint64) []*types.DKGMasterPublicKey {
+	return g.mpks
+}
+
+func (g *testDKGGov) DKGComplaints(round uint64) []*types.DKGComplaint {
+	return g.complaints
+}
+
+type DKGCacheTestSuite struct {
+	suite.Suite
+}
+
+func (s *DKGCacheTestSuite) TestGetQualifiedNodesExcludesComplained() {
+	var (
+		nodes = test.GenerateRandomNodeIDs(2)
+		gov   = &testDKGGov{
+			mpks: []*types.DKGMasterPublicKey{
+				&types.DKGMasterPublicKey{ProposerID: nodes[0]},
+				&types.DKGMasterPublicKey{ProposerID: nodes[1]},
+			},
+			complaints: []*types.DKGComplaint{
+				&types.DKGComplaint{
+					PrivateShare: types.DKGPrivateShare{
+						ProposerID: nodes[1],
+					},
+				},
+			},
+		}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	qualified := cache.GetQualifiedNodes(0)
+	req.Len(qualified, 1)
+	_, exists := qualified[nodes[0]]
+	req.True(exists)
+	_, exists = qualified[nodes[1]]
+	req.False(exists)
+}
+
+func (s *DKGCacheTestSuite) TestTouchForcesRefetch() {
+	var (
+		nodes = test.GenerateRandomNodeIDs(1)
+		gov   = &testDKGGov{
+			mpks: []*types.DKGMasterPublicKey{
+				&types.DKGMasterPublicKey{ProposerID: nodes[0]},
+			},
+		}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	_, exists := cache.GetMPK(0, nodes[0])
+	req.True(exists)
+
+	// A complaint arrives mid-round, disqualifying the only proposer. Until
+	// the round is touched, the cached round data doesn't see it.
+	gov.complaints = []*types.DKGComplaint{
+		&types.DKGComplaint{
+			PrivateShare: types.DKGPrivateShare{ProposerID: nodes[0]},
+		},
+	}
+	qualified := cache.GetQualifiedNodes(0)
+	req.Len(qualified, 1)
+
+	cache.Touch(0)
+	qualified = cache.GetQualifiedNodes(0)
+	req.Len(qualified, 0)
+}
+
+func TestDKGCache(t *testing.T) {
+	suite.Run(t, new(DKGCacheTestSuite))
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"github.com/dexon-foundation/dexon-consensus/core/crypto"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// Governance interface specifies the interface to control the governance
+// contract/module. It's responsible for providing DEXON consensus algorithm
+// related configurations and helping DKG set/signer communicate with each
+// other.
+type Governance interface {
+	// GetConfiguration returns the configuration at a given round.
+	GetConfiguration(round uint64) *types.Config
+
+	// GetCRS returns the CRS for a given round.
+	GetCRS(round uint64) []byte
+
+	// GetNodeSet returns the node set at a given round.
+	GetNodeSet(round uint64) []crypto.PublicKey
+
+	// ProposeThresholdSignature send the threshold signature to governance.
+	ProposeThresholdSignature(round uint64, signature crypto.Signature)
+
+	// GetThresholdSignature returns the threshold signature for a given
+	// round, if it's ready.
+	GetThresholdSignature(round uint64) (crypto.Signature, bool)
+
+	// AddDKGComplaint adds a DKG complaint to governance.
+	AddDKGComplaint(complaint *types.DKGComplaint)
+
+	// DKGComplaints returns the DKG complaints for a given round.
+	DKGComplaints(round uint64) []*types.DKGComplaint
+
+	// AddDKGMasterPublicKey adds a DKG master public key to governance.
+	AddDKGMasterPublicKey(masterPublicKey *types.DKGMasterPublicKey)
+
+	// DKGMasterPublicKeys returns the DKG master public keys for a given
+	// round.
+	DKGMasterPublicKeys(round uint64) []*types.DKGMasterPublicKey
+}
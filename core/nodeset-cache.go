@@ -0,0 +1,497 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/dexon-foundation/dexon-consensus/core/crypto"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// warmupParallelism bounds how many rounds Warmup fetches concurrently.
+const warmupParallelism = 8
+
+// defaultMaxRounds is the distance, in rounds, that the default cache keeps
+// below the highest round fetched so far. Anything older than that gets
+// purged the next time a round is fetched from Governance.
+const defaultMaxRounds = 6
+
+// EvictPolicy selects how NodeSetCache decides which round to drop once
+// MaxRounds is exceeded.
+type EvictPolicy int
+
+// EvictPolicy enums.
+const (
+	// EvictOldestRound purges every round that is MaxRounds or more below
+	// the highest round fetched so far, i.e. the original fixed-distance
+	// behavior.
+	// This fits syncers that only ever walk rounds forward.
+	EvictOldestRound EvictPolicy = iota
+	// EvictLRU purges whichever cached round was least recently accessed,
+	// via GetNodeIDs, Exists, or GetPublicKey. This fits full nodes that
+	// jump across historical rounds, e.g. while syncing.
+	EvictLRU
+)
+
+// NodeSetCacheOptions configures the retention behavior of a NodeSetCache.
+type NodeSetCacheOptions struct {
+	// MaxRounds is the maximum number of rounds kept in the cache at once.
+	MaxRounds int
+	// TTL is how long a round may go unaccessed before it expires. Expired
+	// rounds are purged the next time a round is fetched from Governance;
+	// until then they are still served. Zero means no expiry.
+	TTL time.Duration
+	// Policy picks which round to evict once MaxRounds is exceeded.
+	Policy EvictPolicy
+}
+
+// ErrRoundNotReady would be reported when the round is not ready to be
+// used.
+var ErrRoundNotReady = fmt.Errorf("round is not ready")
+
+// nodeSetCacheSubsetKey identifies a (round, chainID) pair for the derived
+// notary-set cache.
+type nodeSetCacheSubsetKey struct {
+	round   uint64
+	chainID uint32
+}
+
+// nodeSetCacheEntry is the per-round bookkeeping kept by NodeSetCache.
+type nodeSetCacheEntry struct {
+	nIDs       map[types.NodeID]struct{}
+	lastAccess time.Time
+}
+
+// NodeSetCache caches the node sets, together with the notary and DKG sets
+// derived from them, so that repeated lookups don't have to hit Governance
+// on every call.
+type NodeSetCache struct {
+	lock     sync.RWMutex
+	gov      Governance
+	opts     NodeSetCacheOptions
+	maxRound uint64
+	entries  map[uint64]*nodeSetCacheEntry
+	keyPool  map[types.NodeID]*struct {
+		pubKey crypto.PublicKey
+		count  uint
+	}
+	nodeRounds map[types.NodeID]map[uint64]struct{}
+	notarySets map[nodeSetCacheSubsetKey]map[types.NodeID]struct{}
+	dkgSets    map[uint64]map[types.NodeID]struct{}
+	dkgData    map[uint64]*dkgRoundData
+	fetchGroup singleflight.Group
+}
+
+// NewNodeSetCache creates a new NodeSetCache instance using the default
+// retention policy: keep the most recent defaultMaxRounds rounds, evicting
+// the oldest round once that's exceeded.
+func NewNodeSetCache(gov Governance) *NodeSetCache {
+	return NewNodeSetCacheWithOptions(gov, NodeSetCacheOptions{
+		MaxRounds: defaultMaxRounds,
+		Policy:    EvictOldestRound,
+	})
+}
+
+// NewNodeSetCacheWithOptions creates a new NodeSetCache instance with a
+// caller-configured retention policy.
+func NewNodeSetCacheWithOptions(
+	gov Governance, opts NodeSetCacheOptions) *NodeSetCache {
+	if opts.MaxRounds <= 0 {
+		opts.MaxRounds = defaultMaxRounds
+	}
+	return &NodeSetCache{
+		gov:     gov,
+		opts:    opts,
+		entries: make(map[uint64]*nodeSetCacheEntry),
+		keyPool: make(map[types.NodeID]*struct {
+			pubKey crypto.PublicKey
+			count  uint
+		}),
+		nodeRounds: make(map[types.NodeID]map[uint64]struct{}),
+		notarySets: make(map[nodeSetCacheSubsetKey]map[types.NodeID]struct{}),
+		dkgSets:    make(map[uint64]map[types.NodeID]struct{}),
+		dkgData:    make(map[uint64]*dkgRoundData),
+	}
+}
+
+// Exists checks if a node is in a node set of given round.
+func (cache *NodeSetCache) Exists(
+	round uint64, nodeID types.NodeID) (exists bool, err error) {
+	nIDs, err := cache.GetNodeIDs(round)
+	if err != nil {
+		return
+	}
+	_, exists = nIDs[nodeID]
+	return
+}
+
+// GetPublicKey tries to get the public key of the given node ID.
+func (cache *NodeSetCache) GetPublicKey(
+	nID types.NodeID) (key crypto.PublicKey, exists bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	rec, exists := cache.keyPool[nID]
+	if !exists {
+		return
+	}
+	cache.touchNodeNoLock(nID)
+	return rec.pubKey, true
+}
+
+// GetNodeIDs accesses the cached node set for the given round, fetching it
+// from governance when not already cached.
+func (cache *NodeSetCache) GetNodeIDs(
+	round uint64) (nIDs map[types.NodeID]struct{}, err error) {
+	nIDs, err = cache.fetchNodeSet(round)
+	if err != nil {
+		return
+	}
+	return copyNodeSet(nIDs), nil
+}
+
+// GetNotarySet returns the notary set for the given round and chain,
+// derived deterministically from the round's CRS.
+func (cache *NodeSetCache) GetNotarySet(
+	round uint64, chainID uint32) (map[types.NodeID]struct{}, error) {
+	key := nodeSetCacheSubsetKey{round: round, chainID: chainID}
+	cache.lock.Lock()
+	if nIDs, exists := cache.notarySets[key]; exists {
+		cache.touchRoundNoLock(round)
+		cache.lock.Unlock()
+		return copyNodeSet(nIDs), nil
+	}
+	cache.lock.Unlock()
+	cfg := cache.gov.GetConfiguration(round)
+	if cfg == nil {
+		return nil, ErrRoundNotReady
+	}
+	nIDs, err := cache.fetchNodeSet(round)
+	if err != nil {
+		return nil, err
+	}
+	crs := cache.gov.GetCRS(round)
+	notarySet := cache.rankAndFilter(
+		crs, nIDs, chainID, int(cfg.NotarySetSize))
+	cache.lock.Lock()
+	cache.notarySets[key] = notarySet
+	cache.lock.Unlock()
+	return copyNodeSet(notarySet), nil
+}
+
+// GetDKGSet returns the DKG set for the given round, derived
+// deterministically from the round's CRS.
+func (cache *NodeSetCache) GetDKGSet(
+	round uint64) (map[types.NodeID]struct{}, error) {
+	cache.lock.Lock()
+	if dkgSet, exists := cache.dkgSets[round]; exists {
+		cache.touchRoundNoLock(round)
+		cache.lock.Unlock()
+		return copyNodeSet(dkgSet), nil
+	}
+	cache.lock.Unlock()
+	cfg := cache.gov.GetConfiguration(round)
+	if cfg == nil {
+		return nil, ErrRoundNotReady
+	}
+	nIDs, err := cache.fetchNodeSet(round)
+	if err != nil {
+		return nil, err
+	}
+	crs := cache.gov.GetCRS(round)
+	dkgSet := cache.rankAndFilter(crs, nIDs, 0, int(cfg.DKGSetSize))
+	cache.lock.Lock()
+	cache.dkgSets[round] = dkgSet
+	cache.lock.Unlock()
+	return copyNodeSet(dkgSet), nil
+}
+
+// Purge drops a cached round, together with its derived notary/DKG sets and
+// DKG data. It's a no-op when the round isn't cached.
+func (cache *NodeSetCache) Purge(round uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.purgeRoundNoLock(round)
+}
+
+// Warmup fetches and caches the node sets for the given rounds ahead of
+// time, so that the first consensus message of a new round doesn't block on
+// a synchronous governance round-trip. Fetches run concurrently, bounded by
+// warmupParallelism, and concurrent callers asking for the same round (be it
+// from separate Warmup calls or a racing GetNodeIDs) are deduplicated into a
+// single governance fetch.
+func (cache *NodeSetCache) Warmup(
+	ctx context.Context, rounds []uint64) error {
+	sem := make(chan struct{}, warmupParallelism)
+	errCh := make(chan error, len(rounds))
+	var wg sync.WaitGroup
+	for _, round := range rounds {
+		round := round
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, err := cache.fetchNodeSet(round)
+			if err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rankAndFilter sorts the given node set by H(CRS || nodeID || chainID) and
+// picks the k smallest.
+func (cache *NodeSetCache) rankAndFilter(
+	crs []byte,
+	nIDs map[types.NodeID]struct{},
+	chainID uint32,
+	size int) map[types.NodeID]struct{} {
+
+	type ranked struct {
+		nID types.NodeID
+		num *big.Int
+	}
+	sortedIDs := make(types.NodeIDs, 0, len(nIDs))
+	for nID := range nIDs {
+		sortedIDs = append(sortedIDs, nID)
+	}
+	sort.Sort(sortedIDs)
+
+	ranks := make([]ranked, 0, len(sortedIDs))
+	chainIDBytes := make([]byte, 4)
+	chainIDBytes[0] = byte(chainID)
+	chainIDBytes[1] = byte(chainID >> 8)
+	chainIDBytes[2] = byte(chainID >> 16)
+	chainIDBytes[3] = byte(chainID >> 24)
+	for _, nID := range sortedIDs {
+		h := crypto.Keccak256Hash(crs, nID.Hash[:], chainIDBytes)
+		num := new(big.Int).SetBytes(h[:])
+		ranks = append(ranks, ranked{nID: nID, num: num})
+	}
+	sort.Slice(ranks, func(i, j int) bool {
+		return ranks[i].num.Cmp(ranks[j].num) < 0
+	})
+	if size > len(ranks) {
+		size = len(ranks)
+	}
+	result := make(map[types.NodeID]struct{}, size)
+	for _, r := range ranks[:size] {
+		result[r.nID] = struct{}{}
+	}
+	return result
+}
+
+// fetchNodeSet returns the cached node set for a round, fetching it from
+// Governance on a miss. Concurrent misses for the same round are collapsed
+// into a single Governance call via cache.fetchGroup, so a thundering herd
+// asking for a freshly-needed round doesn't translate into a thundering herd
+// of identical governance round-trips.
+func (cache *NodeSetCache) fetchNodeSet(
+	round uint64) (map[types.NodeID]struct{}, error) {
+	cache.lock.Lock()
+	if entry, exists := cache.entries[round]; exists {
+		entry.lastAccess = time.Now()
+		nIDs := entry.nIDs
+		cache.lock.Unlock()
+		return nIDs, nil
+	}
+	cache.lock.Unlock()
+
+	v, err, _ := cache.fetchGroup.Do(
+		fmt.Sprintf("%d", round), func() (interface{}, error) {
+			cache.lock.Lock()
+			if entry, exists := cache.entries[round]; exists {
+				entry.lastAccess = time.Now()
+				cache.lock.Unlock()
+				return entry.nIDs, nil
+			}
+			cache.lock.Unlock()
+
+			keys := cache.gov.GetNodeSet(round)
+			if keys == nil {
+				return nil, ErrRoundNotReady
+			}
+			nIDs := make(map[types.NodeID]struct{}, len(keys))
+			for _, key := range keys {
+				nIDs[types.NewNodeID(key)] = struct{}{}
+			}
+
+			cache.lock.Lock()
+			defer cache.lock.Unlock()
+			for _, key := range keys {
+				cache.addKeyNoLock(types.NewNodeID(key), key, round)
+			}
+			cache.entries[round] = &nodeSetCacheEntry{
+				nIDs:       nIDs,
+				lastAccess: time.Now(),
+			}
+			if round > cache.maxRound {
+				cache.maxRound = round
+			}
+			cache.evictNoLock()
+			return nIDs, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[types.NodeID]struct{}), nil
+}
+
+func (cache *NodeSetCache) touchRoundNoLock(round uint64) {
+	if entry, exists := cache.entries[round]; exists {
+		entry.lastAccess = time.Now()
+	}
+}
+
+func (cache *NodeSetCache) touchNodeNoLock(nID types.NodeID) {
+	for round := range cache.nodeRounds[nID] {
+		cache.touchRoundNoLock(round)
+	}
+}
+
+func (cache *NodeSetCache) addKeyNoLock(
+	nID types.NodeID, key crypto.PublicKey, round uint64) {
+	rec, exists := cache.keyPool[nID]
+	if !exists {
+		rec = &struct {
+			pubKey crypto.PublicKey
+			count  uint
+		}{pubKey: key}
+		cache.keyPool[nID] = rec
+	}
+	rec.count++
+	if cache.nodeRounds[nID] == nil {
+		cache.nodeRounds[nID] = make(map[uint64]struct{})
+	}
+	cache.nodeRounds[nID][round] = struct{}{}
+}
+
+// evictNoLock purges cached rounds per the configured TTL and eviction
+// policy. The caller must hold cache.lock.
+func (cache *NodeSetCache) evictNoLock() {
+	if cache.opts.TTL > 0 {
+		deadline := time.Now().Add(-cache.opts.TTL)
+		for round, entry := range cache.entries {
+			if entry.lastAccess.Before(deadline) {
+				cache.purgeRoundNoLock(round)
+			}
+		}
+	}
+	switch cache.opts.Policy {
+	case EvictLRU:
+		// Cap the cache at MaxRounds entries, dropping whichever round was
+		// least recently touched.
+		for len(cache.entries) > cache.opts.MaxRounds {
+			cache.purgeRoundNoLock(cache.pickLRURoundNoLock())
+		}
+	default:
+		// Mirror the original fixed round-distance behavior: drop any round
+		// that has fallen more than MaxRounds behind the highest round ever
+		// seen, regardless of how many rounds are currently cached.
+		for round := range cache.entries {
+			if round+uint64(cache.opts.MaxRounds) <= cache.maxRound {
+				cache.purgeRoundNoLock(round)
+			}
+		}
+	}
+}
+
+func (cache *NodeSetCache) pickLRURoundNoLock() uint64 {
+	var (
+		victim   uint64
+		oldest   time.Time
+		assigned bool
+	)
+	for round, entry := range cache.entries {
+		if !assigned || entry.lastAccess.Before(oldest) {
+			victim, oldest, assigned = round, entry.lastAccess, true
+		}
+	}
+	return victim
+}
+
+// purgeRoundNoLock drops a single round, together with everything derived
+// from it. The caller must hold cache.lock.
+func (cache *NodeSetCache) purgeRoundNoLock(round uint64) {
+	entry, exists := cache.entries[round]
+	if !exists {
+		return
+	}
+	for nID := range entry.nIDs {
+		cache.removeKeyNoLock(nID, round)
+	}
+	delete(cache.entries, round)
+	delete(cache.dkgSets, round)
+	delete(cache.dkgData, round)
+	for key := range cache.notarySets {
+		if key.round == round {
+			delete(cache.notarySets, key)
+		}
+	}
+}
+
+func (cache *NodeSetCache) removeKeyNoLock(nID types.NodeID, round uint64) {
+	delete(cache.nodeRounds[nID], round)
+	if len(cache.nodeRounds[nID]) == 0 {
+		delete(cache.nodeRounds, nID)
+	}
+	rec, exists := cache.keyPool[nID]
+	if !exists {
+		return
+	}
+	rec.count--
+	if rec.count == 0 {
+		delete(cache.keyPool, nID)
+	}
+}
+
+// copyNodeSet returns a defensive copy of a node set so that callers can
+// freely mutate the returned map.
+func copyNodeSet(
+	nIDs map[types.NodeID]struct{}) map[types.NodeID]struct{} {
+	cp := make(map[types.NodeID]struct{}, len(nIDs))
+	for nID := range nIDs {
+		cp[nID] = struct{}{}
+	}
+	return cp
+}
@@ -1,28 +1,29 @@
-// Copyright 2018 The dexon-consensus-core Authors
-// This file is part of the dexon-consensus-core library.
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
 //
-// The dexon-consensus-core library is free software: you can redistribute it
+// The dexon-consensus library is free software: you can redistribute it
 // and/or modify it under the terms of the GNU Lesser General Public License as
 // published by the Free Software Foundation, either version 3 of the License,
 // or (at your option) any later version.
 //
-// The dexon-consensus-core library is distributed in the hope that it will be
+// The dexon-consensus library is distributed in the hope that it will be
 // useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
 // MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
 // General Public License for more details.
 //
 // You should have received a copy of the GNU Lesser General Public License
-// along with the dexon-consensus-core library. If not, see
+// along with the dexon-consensus library. If not, see
 // <http://www.gnu.org/licenses/>.
 
 package core
 
 import (
+	"context"
 	"testing"
 
-	"github.com/dexon-foundation/dexon-consensus-core/core/crypto"
-	"github.com/dexon-foundation/dexon-consensus-core/core/crypto/ecdsa"
-	"github.com/dexon-foundation/dexon-consensus-core/core/types"
+	"github.com/dexon-foundation/dexon-consensus/core/crypto"
+	"github.com/dexon-foundation/dexon-consensus/core/crypto/ecdsa"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -31,8 +32,15 @@ type testGov struct {
 	curKeys []crypto.PublicKey
 }
 
-func (g *testGov) GetConfiguration(round uint64) (cfg *types.Config) { return }
-func (g *testGov) GetCRS(round uint64) (b []byte)                    { return }
+func (g *testGov) GetConfiguration(round uint64) (cfg *types.Config) {
+	return &types.Config{
+		NotarySetSize: 4,
+		DKGSetSize:    6,
+	}
+}
+func (g *testGov) GetCRS(round uint64) (b []byte) {
+	return []byte{byte(round), 0, 0, 0}
+}
 func (g *testGov) GetNodeSet(round uint64) []crypto.PublicKey {
 	// Randomly generating keys, and check them for verification.
 	g.curKeys = []crypto.PublicKey{}
@@ -109,6 +117,140 @@ func (s *NodeSetCacheTestSuite) TestBasicUsage() {
 	}
 }
 
+func (s *NodeSetCacheTestSuite) TestGetNotarySetAndDKGSet() {
+	var (
+		gov   = &testGov{s: s}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	// Set sizes should match what governance reports.
+	notarySet, err := cache.GetNotarySet(0, 0)
+	req.NoError(err)
+	req.Len(notarySet, 4)
+
+	dkgSet, err := cache.GetDKGSet(0)
+	req.NoError(err)
+	req.Len(dkgSet, 6)
+
+	// Requesting the same (round, chainID) again must yield the same
+	// answer as the cached one, and the returned map must be a defensive
+	// copy that's safe to mutate.
+	notarySetAgain, err := cache.GetNotarySet(0, 0)
+	req.NoError(err)
+	req.Equal(notarySet, notarySetAgain)
+	for nID := range notarySetAgain {
+		delete(notarySetAgain, nID)
+		break
+	}
+	req.NotEqual(notarySet, notarySetAgain)
+}
+
+func (s *NodeSetCacheTestSuite) TestNotarySetDeterminism() {
+	// The underlying node set is populated via a prior GetNodeIDs call, so
+	// GetNotarySet finds it cached: the notary set must be a subset of that
+	// exact node set and must not trigger another random draw from
+	// governance.
+	var (
+		gov   = &testGov{s: s}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	nodeSet, err := cache.GetNodeIDs(3)
+	req.NoError(err)
+
+	notarySet, err := cache.GetNotarySet(3, 2)
+	req.NoError(err)
+	for nID := range notarySet {
+		req.Contains(nodeSet, nID)
+	}
+
+	// Re-deriving should return the exact same notary set, proving the
+	// result is cached rather than recomputed from a freshly drawn node
+	// set.
+	notarySetAgain, err := cache.GetNotarySet(3, 2)
+	req.NoError(err)
+	req.Equal(notarySet, notarySetAgain)
+}
+
+func (s *NodeSetCacheTestSuite) TestPurgeDerivedSets() {
+	// Purging a round's node set should also purge its derived notary/DKG
+	// sets, so a later lookup has to re-derive rather than silently serving
+	// a stale entry from a different node set.
+	var (
+		gov   = &testGov{s: s}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	_, err := cache.GetNotarySet(0, 0)
+	req.NoError(err)
+	_, err = cache.GetDKGSet(0)
+	req.NoError(err)
+
+	// Fetching round 6 should purge round 0's node set, along with its
+	// derived notary/DKG sets.
+	_, err = cache.GetNodeIDs(6)
+	req.NoError(err)
+
+	cache.lock.RLock()
+	_, notaryExists := cache.notarySets[nodeSetCacheSubsetKey{round: 0, chainID: 0}]
+	_, dkgExists := cache.dkgSets[0]
+	cache.lock.RUnlock()
+	req.False(notaryExists)
+	req.False(dkgExists)
+}
+
+func (s *NodeSetCacheTestSuite) TestEvictLRU() {
+	var (
+		gov   = &testGov{s: s}
+		cache = NewNodeSetCacheWithOptions(gov, NodeSetCacheOptions{
+			MaxRounds: 2,
+			Policy:    EvictLRU,
+		})
+		req = s.Require()
+	)
+
+	nodeSet0, err := cache.GetNodeIDs(0)
+	req.NoError(err)
+	_, err = cache.GetNodeIDs(1)
+	req.NoError(err)
+	// Touch round 0 again so it becomes the most recently used entry.
+	_, err = cache.GetNodeIDs(0)
+	req.NoError(err)
+	// Adding round 2 should now evict round 1, the least recently used
+	// entry, rather than round 0.
+	_, err = cache.GetNodeIDs(2)
+	req.NoError(err)
+
+	for nID := range nodeSet0 {
+		_, exists := cache.GetPublicKey(nID)
+		req.True(exists)
+	}
+}
+
+func (s *NodeSetCacheTestSuite) TestWarmupAndPurge() {
+	var (
+		gov   = &testGov{s: s}
+		cache = NewNodeSetCache(gov)
+		req   = s.Require()
+	)
+
+	req.NoError(cache.Warmup(context.Background(), []uint64{1, 2, 3, 1, 2}))
+	for _, round := range []uint64{1, 2, 3} {
+		nodeSet, err := cache.GetNodeIDs(round)
+		req.NoError(err)
+		req.NotEmpty(nodeSet)
+	}
+
+	cache.Purge(2)
+	_, exists := cache.entries[2]
+	req.False(exists)
+	_, exists = cache.entries[1]
+	req.True(exists)
+}
+
 func TestNodeSetCache(t *testing.T) {
 	suite.Run(t, new(NodeSetCacheTestSuite))
-}
\ No newline at end of file
+}
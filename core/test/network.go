@@ -23,20 +23,20 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/dexon-foundation/dexon-consensus/common"
+	"github.com/dexon-foundation/dexon-consensus/core"
 	"github.com/dexon-foundation/dexon-consensus/core/crypto"
 	"github.com/dexon-foundation/dexon-consensus/core/types"
 	typesDKG "github.com/dexon-foundation/dexon-consensus/core/types/dkg"
 )
 
 const (
-	// Count of rounds of notary set cached in network module.
-	cachedNotarySetSize = 10
 	// Count of maximum count of peers to pull votes from.
 	maxPullingPeerCount = 3
 )
@@ -56,6 +56,22 @@ type NetworkConfig struct {
 	Type       NetworkType
 	PeerServer string
 	PeerPort   int
+	// Fanout is the number of random peers each gossip hop relays a message
+	// to. Zero (the default) keeps the historical all-to-all
+	// trans.Broadcast behavior instead of gossiping.
+	Fanout int
+	// GossipTTL bounds how many times a gossiped message may be relayed
+	// before a hop drops it, so it can't propagate forever.
+	GossipTTL int
+}
+
+// gossipEnvelope wraps a message relayed through the gossip fanout so each
+// hop knows how many further hops it may relay onward. Duplicate
+// suppression is keyed off the payload's own identity (block hash, vote
+// header, ...) rather than anything carried in the envelope itself.
+type gossipEnvelope struct {
+	TTL     int
+	Payload interface{}
 }
 
 // PullRequest is a generic request to pull everything (ex. vote, block...).
@@ -132,22 +148,25 @@ type Network struct {
 	ctxCancel            context.CancelFunc
 	trans                TransportClient
 	fromTransport        <-chan *TransportEnvelope
-	toConsensus          chan interface{}
-	toNode               chan interface{}
+	toConsensus          chan types.Msg
+	toNode               chan types.Msg
 	sentRandomnessLock   sync.Mutex
 	sentRandomness       map[common.Hash]struct{}
 	sentAgreementLock    sync.Mutex
 	sentAgreement        map[common.Hash]struct{}
+	sentBlocksLock       sync.Mutex
+	sentBlocks           map[common.Hash]struct{}
+	sentVotesLock        sync.Mutex
+	sentVotes            map[types.VoteHeader]struct{}
 	blockCacheLock       sync.RWMutex
 	blockCache           map[common.Hash]*types.Block
+	nonFinalizedBlocks   map[common.Hash]*types.Block
 	voteCacheLock        sync.RWMutex
 	voteCache            map[types.Position]map[types.VoteHeader]*types.Vote
 	voteCacheSize        int
 	votePositions        []types.Position
 	stateModule          *State
-	notarySetLock        sync.RWMutex
-	notarySets           []map[types.NodeID]struct{}
-	notarySetMinRound    uint64
+	nodeSetCache         *core.NodeSetCache
 	peers                map[types.NodeID]struct{}
 	unreceivedBlocksLock sync.RWMutex
 	unreceivedBlocks     map[common.Hash]chan<- common.Hash
@@ -155,20 +174,27 @@ type Network struct {
 }
 
 // NewNetwork setup network stuffs for nodes, which provides an
-// implementation of core.Network based on TransportClient.
+// implementation of core.Network based on TransportClient. gov resolves the
+// notary/DKG sets that BroadcastBlock, BroadcastDKGPrivateShare, etc. confine
+// their traffic to.
 func NewNetwork(pubKey crypto.PublicKey, latency LatencyModel,
-	marshaller Marshaller, config NetworkConfig) (n *Network) {
+	marshaller Marshaller, gov core.Governance,
+	config NetworkConfig) (n *Network) {
 	// Construct basic network instance.
 	n = &Network{
-		ID:               types.NewNodeID(pubKey),
-		config:           config,
-		toConsensus:      make(chan interface{}, 1000),
-		toNode:           make(chan interface{}, 1000),
-		sentRandomness:   make(map[common.Hash]struct{}),
-		sentAgreement:    make(map[common.Hash]struct{}),
-		blockCache:       make(map[common.Hash]*types.Block),
-		unreceivedBlocks: make(map[common.Hash]chan<- common.Hash),
-		latencyModel:     latency,
+		ID:                 types.NewNodeID(pubKey),
+		config:             config,
+		toConsensus:        make(chan types.Msg, 1000),
+		toNode:             make(chan types.Msg, 1000),
+		sentRandomness:     make(map[common.Hash]struct{}),
+		sentAgreement:      make(map[common.Hash]struct{}),
+		sentBlocks:         make(map[common.Hash]struct{}),
+		sentVotes:          make(map[types.VoteHeader]struct{}),
+		blockCache:         make(map[common.Hash]*types.Block),
+		nonFinalizedBlocks: make(map[common.Hash]*types.Block),
+		unreceivedBlocks:   make(map[common.Hash]chan<- common.Hash),
+		latencyModel:       latency,
+		nodeSetCache:       core.NewNodeSetCache(gov),
 		voteCache: make(
 			map[types.Position]map[types.VoteHeader]*types.Vote),
 	}
@@ -199,18 +225,34 @@ func (n *Network) PullVotes(pos types.Position) {
 
 // BroadcastVote implements core.Network interface.
 func (n *Network) BroadcastVote(vote *types.Vote) {
-	if err := n.trans.Broadcast(vote); err != nil {
+	if n.config.Fanout > 0 {
+		if !n.voteAlreadySent(vote.VoteHeader) {
+			n.gossipFanout(vote, n.config.GossipTTL, n.ID)
+		}
+	} else if err := n.trans.Broadcast(vote); err != nil {
 		panic(err)
 	}
 	n.addVoteToCache(vote)
 }
 
-// BroadcastBlock implements core.Network interface.
+// BroadcastBlock implements core.Network interface. A finalized block is
+// gossiped to every peer (falling back to a direct trans.Broadcast when no
+// Fanout is configured) as before; a non-finalized one is only relevant to
+// the notary set voting on its round, so it's confined to that set instead
+// of blowing up bandwidth across the whole network.
 func (n *Network) BroadcastBlock(block *types.Block) {
 	// Avoid data race in fake transport.
 	block = n.cloneForFake(block).(*types.Block)
-	if err := n.trans.Broadcast(block); err != nil {
-		panic(err)
+	if block.IsFinalized() {
+		if n.config.Fanout > 0 {
+			if !n.blockAlreadySent(block.Hash) {
+				n.gossipFanout(block, n.config.GossipTTL, n.ID)
+			}
+		} else if err := n.trans.Broadcast(block); err != nil {
+			panic(err)
+		}
+	} else {
+		n.sendToNotarySet(block.Position.Round, block.Position.ChainID, block)
 	}
 	n.addBlockToCache(block)
 }
@@ -272,24 +314,44 @@ func (n *Network) SendDKGPrivateShare(
 	}
 }
 
-// BroadcastDKGPrivateShare implements core.Network interface.
+// BroadcastDKGPrivateShare implements core.Network interface. DKG traffic is
+// only meaningful to the round's DKG set, so unlike the other Broadcast*
+// calls this fans out to that set alone instead of every peer, cutting the
+// transport load quadratically at large N.
 func (n *Network) BroadcastDKGPrivateShare(
 	prvShare *typesDKG.PrivateShare) {
-	if err := n.trans.Broadcast(prvShare); err != nil {
-		panic(err)
-	}
+	n.sendToDKGSet(prvShare.Round, prvShare)
 }
 
-// BroadcastDKGPartialSignature implements core.Network interface.
+// BroadcastDKGPartialSignature implements core.Network interface. See
+// BroadcastDKGPrivateShare: DKG partial signatures are likewise confined to
+// the round's DKG set.
 func (n *Network) BroadcastDKGPartialSignature(
 	psig *typesDKG.PartialSignature) {
-	if err := n.trans.Broadcast(psig); err != nil {
-		panic(err)
+	n.sendToDKGSet(psig.Round, psig)
+}
+
+// sendToDKGSet delivers msg to every member of round's DKG set, except this
+// node itself. The set is resolved (and memoized) via n.nodeSetCache, so
+// repeated calls for the same round don't re-derive it from the CRS.
+func (n *Network) sendToDKGSet(round uint64, msg interface{}) {
+	dkgSet, err := n.nodeSetCache.GetDKGSet(round)
+	if err != nil {
+		log.Println("unable to resolve DKG set", round, err)
+		return
+	}
+	for nID := range dkgSet {
+		if nID == n.ID {
+			continue
+		}
+		if err := n.trans.Send(nID, msg); err != nil {
+			log.Println("unable to send DKG message", nID, err)
+		}
 	}
 }
 
 // ReceiveChan implements core.Network interface.
-func (n *Network) ReceiveChan() <-chan interface{} {
+func (n *Network) ReceiveChan() <-chan types.Msg {
 	return n.toConsensus
 }
 
@@ -319,6 +381,41 @@ func (n *Network) Setup(serverEndpoint interface{}) (err error) {
 
 func (n *Network) dispatchMsg(e *TransportEnvelope) {
 	msg := n.cloneForFake(e.Msg)
+	if env, ok := msg.(*gossipEnvelope); ok {
+		if n.relayGossip(env, e.PeerID) {
+			// Already seen this message through an earlier hop: drop it
+			// instead of re-delivering or relaying it again.
+			return
+		}
+		msg = n.cloneForFake(env.Payload)
+	}
+	n.handlePayload(e.PeerID, msg)
+}
+
+// relayGossip applies per-payload duplicate suppression to a received
+// gossip hop and, if env still has hops left, relays it onward to a fresh
+// Fanout of peers. It reports whether the payload had already been seen.
+func (n *Network) relayGossip(env *gossipEnvelope, from types.NodeID) bool {
+	var alreadySent bool
+	switch payload := env.Payload.(type) {
+	case *types.Block:
+		alreadySent = n.blockAlreadySent(payload.Hash)
+	case *types.Vote:
+		alreadySent = n.voteAlreadySent(payload.VoteHeader)
+	}
+	if alreadySent {
+		return true
+	}
+	if env.TTL > 0 {
+		n.gossipFanout(env.Payload, env.TTL-1, from)
+	}
+	return false
+}
+
+func (n *Network) handlePayload(peerID types.NodeID, msg interface{}) {
+	toConsensus := func(payload interface{}) {
+		n.toConsensus <- types.Msg{PeerID: peerID, Payload: payload}
+	}
 	switch v := msg.(type) {
 	case *types.Block:
 		n.addBlockToCache(v)
@@ -330,14 +427,19 @@ func (n *Network) dispatchMsg(e *TransportEnvelope) {
 				ch <- v.Hash
 			}
 		}()
-		n.toConsensus <- v
+		toConsensus(v)
 	case *types.Vote:
 		// Add this vote to cache.
 		n.addVoteToCache(v)
-		n.toConsensus <- v
-	case *types.AgreementResult, *types.BlockRandomnessResult,
+		toConsensus(v)
+	case *types.AgreementResult:
+		// Upgrade the matching cached block, if any, from non-finalized to
+		// finalized now that it has a randomness result.
+		n.promoteFinalizedBlock(v)
+		toConsensus(v)
+	case *types.BlockRandomnessResult,
 		*typesDKG.PrivateShare, *typesDKG.PartialSignature:
-		n.toConsensus <- v
+		toConsensus(v)
 	case packedStateChanges:
 		if n.stateModule == nil {
 			panic(errors.New(
@@ -349,7 +451,7 @@ func (n *Network) dispatchMsg(e *TransportEnvelope) {
 	case *PullRequest:
 		go n.handlePullRequest(v)
 	default:
-		n.toNode <- v
+		n.toNode <- types.Msg{PeerID: peerID, Payload: v}
 	}
 }
 
@@ -364,7 +466,10 @@ func (n *Network) handlePullRequest(req *PullRequest) {
 			for _, h := range hashes {
 				b, exists := n.blockCache[h]
 				if !exists {
-					continue
+					b, exists = n.nonFinalizedBlocks[h]
+					if !exists {
+						continue
+					}
 				}
 				select {
 				case <-n.ctx.Done():
@@ -439,8 +544,15 @@ func (n *Network) Peers() []crypto.PublicKey {
 }
 
 // Broadcast exports 'Broadcast' method of Transport, and would panic when
-// error.
+// error. Like BroadcastBlock/BroadcastVote, it gossips through Fanout peers
+// when configured rather than hitting every peer directly; since an
+// arbitrary message carries no identity to dedup against, only the TTL
+// bounds how far it can propagate.
 func (n *Network) Broadcast(msg interface{}) {
+	if n.config.Fanout > 0 {
+		n.gossipFanout(msg, n.config.GossipTTL, n.ID)
+		return
+	}
 	if err := n.trans.Broadcast(msg); err != nil {
 		panic(err)
 	}
@@ -448,7 +560,7 @@ func (n *Network) Broadcast(msg interface{}) {
 
 // ReceiveChanForNode returns a channel for messages not handled by
 // core.Consensus.
-func (n *Network) ReceiveChanForNode() <-chan interface{} {
+func (n *Network) ReceiveChanForNode() <-chan types.Msg {
 	return n.toNode
 }
 
@@ -457,30 +569,6 @@ func (n *Network) addStateModule(s *State) {
 	n.stateModule = s
 }
 
-// appendRoundSetting updates essential info to network module for each round.
-func (n *Network) appendRoundSetting(
-	round uint64, notarySet map[types.NodeID]struct{}) {
-	n.notarySetLock.Lock()
-	defer n.notarySetLock.Unlock()
-	if len(n.notarySets) != 0 {
-		// This network module is already initialized, do some check against
-		// the inputs.
-		if round != n.notarySetMinRound+uint64(len(n.notarySets)) {
-			panic(fmt.Errorf(
-				"round not increasing when appending round setting: %v", round))
-		}
-	} else {
-		n.notarySetMinRound = round
-	}
-	n.notarySets = append(n.notarySets, notarySet)
-	// Purge cached notary sets.
-	if len(n.notarySets) > cachedNotarySetSize {
-		n.notarySets = n.notarySets[1:]
-		n.notarySetMinRound++
-	}
-	return
-}
-
 func (n *Network) pullBlocksAsync(hashes common.Hashes) {
 	// Setup notification channels for each block hash.
 	notYetReceived := make(map[common.Hash]struct{})
@@ -547,11 +635,11 @@ func (n *Network) pullVotesAsync(pos types.Position) {
 		Identity:  pos,
 	}
 	// Get corresponding notary set.
-	notarySet := func() map[types.NodeID]struct{} {
-		n.notarySetLock.Lock()
-		defer n.notarySetLock.Unlock()
-		return n.notarySets[pos.Round-n.notarySetMinRound]
-	}()
+	notarySet, err := n.nodeSetCache.GetNotarySet(pos.Round, pos.ChainID)
+	if err != nil {
+		log.Println("unable to resolve notary set", pos.Round, err)
+		return
+	}
 	// Randomly select one peer from notary set and send a pull request.
 	sentCount := 0
 	for nID := range notarySet {
@@ -566,9 +654,124 @@ func (n *Network) pullVotesAsync(pos types.Position) {
 	}
 }
 
+// sendToNotarySet delivers msg to every member of (round, chainID)'s notary
+// set. It's used to confine non-finalized block gossip to the nodes
+// actually voting on that round/chain, instead of every peer in the
+// network. The set is resolved (and memoized) via n.nodeSetCache.
+func (n *Network) sendToNotarySet(round uint64, chainID uint32, msg interface{}) {
+	notarySet, err := n.nodeSetCache.GetNotarySet(round, chainID)
+	if err != nil {
+		log.Println("unable to resolve notary set", round, err)
+		return
+	}
+	for nID := range notarySet {
+		if nID == n.ID {
+			continue
+		}
+		if err := n.trans.Send(nID, msg); err != nil {
+			log.Println("unable to send block", nID, err)
+		}
+	}
+}
+
+// gossipFanout sends msg, wrapped with ttl hops remaining, to a random
+// subset of Fanout peers other than exclude (typically this node, when
+// originating, or whoever the hop was just received from, when relaying).
+// Each hop is a fresh trans.Send, so latencyModel.Delay() is paid again per
+// hop for free, same as any other transport round-trip, giving the
+// simulator multi-hop propagation instead of an all-to-all fanout.
+func (n *Network) gossipFanout(msg interface{}, ttl int, exclude types.NodeID) {
+	env := &gossipEnvelope{TTL: ttl, Payload: msg}
+	candidates := make([]types.NodeID, 0, len(n.peers))
+	for nID := range n.peers {
+		if nID == exclude {
+			continue
+		}
+		candidates = append(candidates, nID)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	fanout := n.config.Fanout
+	if fanout > len(candidates) {
+		fanout = len(candidates)
+	}
+	for _, nID := range candidates[:fanout] {
+		if err := n.trans.Send(nID, env); err != nil {
+			log.Println("unable to gossip message", nID, err)
+		}
+	}
+}
+
+// blockAlreadySent reports whether hash has already been gossiped by this
+// node, as either the originator or a relay, marking it sent if not. It's
+// the block analogue of sentRandomness/sentAgreement, shared between
+// BroadcastBlock (to avoid re-originating) and the gossip relay path (to
+// stop an already-seen hop from being relayed again).
+func (n *Network) blockAlreadySent(hash common.Hash) bool {
+	n.sentBlocksLock.Lock()
+	defer n.sentBlocksLock.Unlock()
+	if _, exist := n.sentBlocks[hash]; exist {
+		return true
+	}
+	if len(n.sentBlocks) > 1000 {
+		// Randomly drop one entry.
+		for k := range n.sentBlocks {
+			delete(n.sentBlocks, k)
+			break
+		}
+	}
+	n.sentBlocks[hash] = struct{}{}
+	return false
+}
+
+// voteAlreadySent is blockAlreadySent's vote counterpart, keyed by
+// VoteHeader since votes don't carry a content hash of their own.
+func (n *Network) voteAlreadySent(header types.VoteHeader) bool {
+	n.sentVotesLock.Lock()
+	defer n.sentVotesLock.Unlock()
+	if _, exist := n.sentVotes[header]; exist {
+		return true
+	}
+	if len(n.sentVotes) > 1000 {
+		// Randomly drop one entry.
+		for k := range n.sentVotes {
+			delete(n.sentVotes, k)
+			break
+		}
+	}
+	n.sentVotes[header] = struct{}{}
+	return false
+}
+
+// addBlockToCache files b into the finalized or non-finalized cache
+// depending on b.IsFinalized(), keeping the two disjoint so a stale
+// non-finalized reply can never clobber an already-finalized entry.
 func (n *Network) addBlockToCache(b *types.Block) {
 	n.blockCacheLock.Lock()
 	defer n.blockCacheLock.Unlock()
+	if b.IsFinalized() {
+		delete(n.nonFinalizedBlocks, b.Hash)
+		n.addFinalizedBlockToCacheNoLock(b)
+		return
+	}
+	if _, exists := n.blockCache[b.Hash]; exists {
+		// Already finalized, don't let a non-finalized copy regress it.
+		return
+	}
+	if len(n.nonFinalizedBlocks) > 1000 {
+		// Randomly purge one block from cache.
+		for k := range n.nonFinalizedBlocks {
+			delete(n.nonFinalizedBlocks, k)
+			break
+		}
+	}
+	n.nonFinalizedBlocks[b.Hash] = b
+}
+
+// addFinalizedBlockToCacheNoLock adds b to the finalized cache. The caller
+// must hold blockCacheLock.
+func (n *Network) addFinalizedBlockToCacheNoLock(b *types.Block) {
 	if len(n.blockCache) > 1000 {
 		// Randomly purge one block from cache.
 		for k := range n.blockCache {
@@ -579,6 +782,21 @@ func (n *Network) addBlockToCache(b *types.Block) {
 	n.blockCache[b.Hash] = b
 }
 
+// promoteFinalizedBlock applies an AgreementResult's randomness to the
+// matching cached block, if one is pending as non-finalized, and moves it
+// into the finalized cache.
+func (n *Network) promoteFinalizedBlock(result *types.AgreementResult) {
+	n.blockCacheLock.Lock()
+	defer n.blockCacheLock.Unlock()
+	b, exists := n.nonFinalizedBlocks[result.BlockHash]
+	if !exists {
+		return
+	}
+	b.Randomness = result.Randomness
+	delete(n.nonFinalizedBlocks, result.BlockHash)
+	n.addFinalizedBlockToCacheNoLock(b)
+}
+
 func (n *Network) addVoteToCache(v *types.Vote) {
 	n.voteCacheLock.Lock()
 	defer n.voteCacheLock.Unlock()
@@ -612,4 +830,4 @@ func (n *Network) cloneForFake(v interface{}) interface{} {
 		return cloneBlockRandomnessResult(val)
 	}
 	return v
-}
\ No newline at end of file
+}
@@ -0,0 +1,28 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package test
+
+// Total ordering deliver modes, mirrored from core.totalOrdering so this
+// package can interpret the mode returned alongside delivered block sets
+// without importing core (which would create an import cycle).
+const (
+	TotalOrderingModeError = uint32(iota)
+	TotalOrderingModeNormal
+	TotalOrderingModeEarly
+	TotalOrderingModeFlush
+)
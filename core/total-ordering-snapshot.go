@@ -0,0 +1,188 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dexon-foundation/dexon-consensus/common"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// totalOrderingSnapshotVersion is bumped whenever the encoded layout below
+// changes in an incompatible way.
+const totalOrderingSnapshotVersion = 1
+
+// ErrInvalidSnapshotVersion is returned by LoadTotalOrdering when the blob
+// was produced by an incompatible version of Snapshot.
+var ErrInvalidSnapshotVersion = fmt.Errorf(
+	"total ordering: invalid snapshot version")
+
+// totalOrderingConfigSnapshot is the serializable form of
+// totalOrderingConfig.
+type totalOrderingConfigSnapshot struct {
+	K                 uint64        `json:"k"`
+	Phi               float32       `json:"phi"`
+	NumChains         uint32        `json:"num_chains"`
+	RoundInterval     time.Duration `json:"round_interval"`
+	ExplicitNumChains bool          `json:"explicit_num_chains,omitempty"`
+	ExplicitK         bool          `json:"explicit_k,omitempty"`
+	ExplicitPhi       bool          `json:"explicit_phi,omitempty"`
+}
+
+// totalOrderingCandidateSnapshot is the serializable form of a single
+// candidate's working state. AckedStatus only keeps the slice length:
+// totalOrderingHeightRecord's fields are unexported, so each record is
+// encoded as an empty object. winRecords is omitted. refreshCandidates()
+// rebuilds ackedStatus from the acked map, and the height vector and
+// winRecords from that, right after load.
+type totalOrderingCandidateSnapshot struct {
+	ChainID     uint32                       `json:"chain_id"`
+	Hash        common.Hash                  `json:"hash"`
+	AckedStatus []*totalOrderingHeightRecord `json:"acked_status"`
+}
+
+// totalOrderingSnapshot is the full serializable working state of a
+// totalOrdering instance.
+type totalOrderingSnapshot struct {
+	Version    int                                     `json:"version"`
+	CurRound   uint64                                  `json:"cur_round"`
+	ByProposer bool                                    `json:"by_proposer"`
+	ChainIndex map[types.NodeID]uint32                 `json:"chain_index,omitempty"`
+	Configs    map[uint64]*totalOrderingConfigSnapshot `json:"configs"`
+	Pendings   []*types.Block                          `json:"pendings"`
+	Acked      map[common.Hash][]common.Hash           `json:"acked"`
+	Candidates []*totalOrderingCandidateSnapshot       `json:"candidates"`
+}
+
+// Snapshot serializes the full working state of to: pendings, acked,
+// candidates, candidateChainMapping, every appended round's config and the
+// curRound cursor. A restarting node can load this together with the tail
+// of undelivered blocks to resume producing identical deliver sets, instead
+// of replaying processBlock from genesis.
+func (to *totalOrdering) Snapshot() ([]byte, error) {
+	snapshot := &totalOrderingSnapshot{
+		Version:    totalOrderingSnapshotVersion,
+		CurRound:   to.curRound,
+		ByProposer: to.byProposer,
+		ChainIndex: to.chainIndex,
+		Configs:    make(map[uint64]*totalOrderingConfigSnapshot, len(to.configs)),
+		Pendings:   make([]*types.Block, 0, len(to.pendings)),
+		Acked:      make(map[common.Hash][]common.Hash, len(to.acked)),
+		Candidates: make([]*totalOrderingCandidateSnapshot, 0, len(to.candidates)),
+	}
+	for round, cfg := range to.configs {
+		snapshot.Configs[round] = &totalOrderingConfigSnapshot{
+			K:                 cfg.k,
+			Phi:               cfg.phi,
+			NumChains:         cfg.numChains,
+			RoundInterval:     cfg.roundInterval,
+			ExplicitNumChains: cfg.explicitNumChains,
+			ExplicitK:         cfg.explicitK,
+			ExplicitPhi:       cfg.explicitPhi,
+		}
+	}
+	for _, b := range to.pendings {
+		snapshot.Pendings = append(snapshot.Pendings, b)
+	}
+	for hash, ackers := range to.acked {
+		hashes := make(common.Hashes, 0, len(ackers))
+		for h := range ackers {
+			hashes = append(hashes, h)
+		}
+		snapshot.Acked[hash] = hashes
+	}
+	for chainID, info := range to.candidates {
+		snapshot.Candidates = append(snapshot.Candidates,
+			&totalOrderingCandidateSnapshot{
+				ChainID:     chainID,
+				Hash:        info.hash,
+				AckedStatus: info.ackedStatus,
+			})
+	}
+	return json.Marshal(snapshot)
+}
+
+// LoadTotalOrdering restores a totalOrdering instance from a blob produced
+// by Snapshot. cfg is only used as a fallback to size a fresh
+// totalOrderingObjectCache when the snapshot doesn't already carry a config
+// for curRound; every round's config is otherwise restored verbatim from
+// the snapshot.
+func LoadTotalOrdering(
+	snapshotBytes []byte, cfg *types.Config) (*totalOrdering, error) {
+	var snapshot totalOrderingSnapshot
+	if err := json.Unmarshal(snapshotBytes, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != totalOrderingSnapshotVersion {
+		return nil, ErrInvalidSnapshotVersion
+	}
+	to := &totalOrdering{
+		pendings:              make(map[common.Hash]*types.Block),
+		acked:                 make(map[common.Hash]map[common.Hash]struct{}),
+		candidates:            make(map[uint32]*totalOrderingCandidateInfo),
+		candidateChainMapping: make(map[uint32]common.Hash),
+		configs:               make(map[uint64]*totalOrderingConfig),
+		curRound:              snapshot.CurRound,
+		roundBegun:            map[uint64]struct{}{snapshot.CurRound: {}},
+		byProposer:            snapshot.ByProposer,
+		chainIndex:            snapshot.ChainIndex,
+	}
+	if to.byProposer && to.chainIndex == nil {
+		to.chainIndex = make(map[types.NodeID]uint32)
+	}
+	for round, cfgSnapshot := range snapshot.Configs {
+		to.configs[round] = &totalOrderingConfig{
+			k:                 cfgSnapshot.K,
+			phi:               cfgSnapshot.Phi,
+			numChains:         cfgSnapshot.NumChains,
+			roundInterval:     cfgSnapshot.RoundInterval,
+			explicitNumChains: cfgSnapshot.ExplicitNumChains,
+			explicitK:         cfgSnapshot.ExplicitK,
+			explicitPhi:       cfgSnapshot.ExplicitPhi,
+		}
+	}
+	if curCfg, exists := to.configs[to.curRound]; exists {
+		to.objCache = newTotalOrderingObjectCache(curCfg.numChains)
+	} else {
+		to.objCache = newTotalOrderingObjectCache(cfg.NumChains)
+	}
+	for _, b := range snapshot.Pendings {
+		to.pendings[b.Hash] = b
+	}
+	for hash, ackers := range snapshot.Acked {
+		ackerSet := make(map[common.Hash]struct{}, len(ackers))
+		for _, h := range ackers {
+			ackerSet[h] = struct{}{}
+		}
+		to.acked[hash] = ackerSet
+	}
+	for _, candidateSnapshot := range snapshot.Candidates {
+		to.candidateChainMapping[candidateSnapshot.ChainID] = candidateSnapshot.Hash
+		to.candidates[candidateSnapshot.ChainID] = &totalOrderingCandidateInfo{
+			hash:               candidateSnapshot.Hash,
+			ackedStatus:        candidateSnapshot.AckedStatus,
+			cachedHeightVector: to.objCache.requestHeightVector(),
+			winRecords:         to.objCache.requestWinRecords(),
+		}
+	}
+	to.refreshCandidates()
+	return to, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"time"
+
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// TotalOrderingSyncer bootstraps a totalOrdering instance mid-stream, so a
+// node catching up to a running peer doesn't have to replay the DAG from
+// genesis. It feeds incoming blocks to a probe instance until it observes a
+// delivery that's safe to cut over on (one whose mode wasn't
+// TotalOrderingModeFlush, since a flush can reshuffle blocks across the
+// round boundary), then promotes that same probe into the live instance
+// that subsequent blocks are fed to directly.
+type TotalOrderingSyncer struct {
+	configs    map[uint64]*types.Config
+	firstRound uint64
+
+	probe *totalOrdering
+	to    *totalOrdering
+}
+
+// NewTotalOrderingSyncer creates a syncer that will eventually bootstrap a
+// totalOrdering starting no earlier than firstRound.
+func NewTotalOrderingSyncer(
+	genesisTime time.Time,
+	firstRound uint64,
+	initConfig *types.Config) *TotalOrderingSyncer {
+	return &TotalOrderingSyncer{
+		firstRound: firstRound,
+		configs:    map[uint64]*types.Config{firstRound: initConfig},
+		probe:      newTotalOrdering(genesisTime, firstRound, initConfig),
+	}
+}
+
+// AppendConfig registers the config for an upcoming round, forwarding it to
+// whichever of the probe/live totalOrdering instances is currently active.
+func (syncer *TotalOrderingSyncer) AppendConfig(
+	round uint64, cfg *types.Config) error {
+	if _, exists := syncer.configs[round]; exists {
+		return ErrRoundAlreadyPast
+	}
+	syncer.configs[round] = cfg
+	if syncer.to != nil {
+		return syncer.to.appendConfig(round, cfg)
+	}
+	return syncer.probe.appendConfig(round, cfg)
+}
+
+// Sync feeds one block pulled from a running peer into the syncer. It
+// returns true once the syncer has cut over to a live totalOrdering and is
+// ready to be driven directly via processBlock/Consensus.
+func (syncer *TotalOrderingSyncer) Sync(
+	block *types.Block) (ready bool, err error) {
+	if syncer.to != nil {
+		_, _, err = syncer.to.processBlock(block)
+		return true, err
+	}
+
+	delivered, mode, err := syncer.probe.processBlock(block)
+	if err != nil {
+		return false, err
+	}
+	if len(delivered) == 0 || mode == TotalOrderingModeFlush {
+		return false, nil
+	}
+
+	// Found a safe cut: promote the probe into the live instance directly,
+	// rather than seeding a fresh totalOrdering from its current round.
+	// Building a fresh instance here would drop the probe's accumulated
+	// pendings/acked/candidates, orphaning any chain with an undelivered
+	// candidate still in flight from its ancestors the next time it's fed
+	// back in.
+	syncer.to = syncer.probe
+	syncer.probe = nil
+	return true, nil
+}
+
+// Consensus returns the live totalOrdering instance once Sync has cut over,
+// or nil if bootstrap hasn't completed yet.
+func (syncer *TotalOrderingSyncer) Consensus() *totalOrdering {
+	return syncer.to
+}
@@ -0,0 +1,847 @@
+// Copyright 2018 The dexon-consensus Authors
+// This file is part of the dexon-consensus library.
+//
+// The dexon-consensus library is free software: you can redistribute it
+// and/or modify it under the terms of the GNU Lesser General Public License as
+// published by the Free Software Foundation, either version 3 of the License,
+// or (at your option) any later version.
+//
+// The dexon-consensus library is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU Lesser
+// General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the dexon-consensus library. If not, see
+// <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dexon-foundation/dexon-consensus/common"
+	"github.com/dexon-foundation/dexon-consensus/core/types"
+)
+
+// Total ordering deliver modes.
+const (
+	TotalOrderingModeError = uint32(iota)
+	TotalOrderingModeNormal
+	TotalOrderingModeEarly
+	TotalOrderingModeFlush
+)
+
+// infinity is used as a height vector entry meaning "confirmed to never be
+// acked by this chain".
+const infinity = math.MaxUint64
+
+// ErrRoundAlreadyPast is reported when appendConfig is called for round 0
+// or for a round that already has a config appended.
+var ErrRoundAlreadyPast = fmt.Errorf(
+	"total ordering: round is already past")
+
+// ErrRoundNotAppended is reported when a round has no registered config.
+var ErrRoundNotAppended = fmt.Errorf(
+	"total ordering: round config not appended")
+
+// ErrRoundNotPast is reported by Flush when roundID hasn't been superseded
+// by curRound yet, i.e. flushing it could still race a normal delivery.
+var ErrRoundNotPast = fmt.Errorf(
+	"total ordering: round is not past yet")
+
+// totalOrderingHeightRecord tracks, for one acking chain, the lowest height
+// at which a run of consecutive blocks ack a given candidate.
+type totalOrderingHeightRecord struct {
+	minHeight uint64
+	count     uint64
+}
+
+// totalOrderingWinRecord remembers, per acking chain, whether the owning
+// candidate is currently known to precede another candidate.
+type totalOrderingWinRecord struct {
+	wins  []bool
+	count int
+}
+
+func newTotalOrderingWinRecord(numChains uint32) *totalOrderingWinRecord {
+	return &totalOrderingWinRecord{wins: make([]bool, numChains)}
+}
+
+// grade turns a win record into a -1/0/1 verdict: 1 means the owning
+// candidate is ordered before the other one, -1 means after, 0 means no
+// majority has formed yet.
+func (rec *totalOrderingWinRecord) grade(
+	numChains uint32, phi float32, ansLength uint64) int {
+	threshold := uint64(math.Ceil(float64(phi)))
+	if uint64(rec.count) >= threshold {
+		return 1
+	}
+	if ansLength < threshold {
+		return 0
+	}
+	if uint64(numChains)-uint64(rec.count) > threshold {
+		return 0
+	}
+	return -1
+}
+
+// totalOrderingCandidateInfo is the working state kept for one candidate
+// block while it's competing to be delivered.
+type totalOrderingCandidateInfo struct {
+	hash               common.Hash
+	ackedStatus        []*totalOrderingHeightRecord
+	cachedHeightVector []uint64
+	winRecords         []*totalOrderingWinRecord
+}
+
+func newTotalOrderingCandidateInfo(
+	hash common.Hash, cache *totalOrderingObjectCache) *totalOrderingCandidateInfo {
+	return &totalOrderingCandidateInfo{
+		hash:               hash,
+		ackedStatus:        cache.requestAckedStatus(),
+		cachedHeightVector: cache.requestHeightVector(),
+		winRecords:         cache.requestWinRecords(),
+	}
+}
+
+// updateAckingHeightVector recomputes cachedHeightVector from ackedStatus,
+// given the acking info of a reference ("global") candidate and the current
+// K parameter. A chain contributes this candidate's minHeight on it when
+// that minHeight is at most the global minHeight plus k, and infinity when
+// it's higher. A chain that hasn't acked this candidate contributes
+// infinity if it has acked the global reference, and 0 otherwise.
+func (info *totalOrderingCandidateInfo) updateAckingHeightVector(
+	global *totalOrderingCandidateInfo,
+	k uint64,
+	dirtyChainIDs []int,
+	cache *totalOrderingObjectCache) {
+	if info.cachedHeightVector == nil {
+		info.cachedHeightVector = cache.requestHeightVector()
+	}
+	for _, chainID := range dirtyChainIDs {
+		local := info.ackedStatus[chainID]
+		globalStatus := global.ackedStatus[chainID]
+		switch {
+		case local.count == 0:
+			if globalStatus.count == 0 {
+				info.cachedHeightVector[chainID] = 0
+			} else {
+				info.cachedHeightVector[chainID] = infinity
+			}
+		case local.minHeight > globalStatus.minHeight+k:
+			info.cachedHeightVector[chainID] = infinity
+		default:
+			info.cachedHeightVector[chainID] = local.minHeight
+		}
+	}
+}
+
+// getAckingNodeSetLength returns how many chains, among chains 0 to
+// numChains-1, have acked this candidate at least k times according to
+// ackedStatus. global is not consulted.
+func (info *totalOrderingCandidateInfo) getAckingNodeSetLength(
+	global *totalOrderingCandidateInfo, k uint64, numChains uint32) uint64 {
+	var count uint64
+	for i := uint32(0); i < numChains; i++ {
+		if info.ackedStatus[i].count >= k {
+			count++
+		}
+	}
+	return count
+}
+
+// updateWinRecord refreshes the per-chain win bitmap of info against other,
+// where other is tracked under chainID in info's winRecords slice.
+func (info *totalOrderingCandidateInfo) updateWinRecord(
+	chainID uint32,
+	other *totalOrderingCandidateInfo,
+	dirtyChainIDs []int,
+	cache *totalOrderingObjectCache,
+	numChains uint32) {
+	rec := info.winRecords[chainID]
+	if rec == nil {
+		rec = newTotalOrderingWinRecord(numChains)
+		info.winRecords[chainID] = rec
+	}
+	for _, idx := range dirtyChainIDs {
+		selfHeight := info.cachedHeightVector[idx]
+		otherHeight := other.cachedHeightVector[idx]
+		win := selfHeight != infinity &&
+			(otherHeight == infinity || selfHeight < otherHeight)
+		if rec.wins[idx] != win {
+			if win {
+				rec.count++
+			} else {
+				rec.count--
+			}
+			rec.wins[idx] = win
+		}
+	}
+}
+
+// totalOrderingObjectCache hands out reusable slices for
+// totalOrderingCandidateInfo so the hot path doesn't churn the allocator on
+// every new candidate.
+type totalOrderingObjectCache struct {
+	numChains       uint32
+	ackedStatusPool [][]*totalOrderingHeightRecord
+	heightVecPool   [][]uint64
+	winRecordsPool  [][]*totalOrderingWinRecord
+}
+
+func newTotalOrderingObjectCache(numChains uint32) *totalOrderingObjectCache {
+	return &totalOrderingObjectCache{numChains: numChains}
+}
+
+func (cache *totalOrderingObjectCache) requestAckedStatus() []*totalOrderingHeightRecord {
+	if n := len(cache.ackedStatusPool); n > 0 {
+		s := cache.ackedStatusPool[n-1]
+		cache.ackedStatusPool = cache.ackedStatusPool[:n-1]
+		return s
+	}
+	s := make([]*totalOrderingHeightRecord, cache.numChains)
+	for i := range s {
+		s[i] = &totalOrderingHeightRecord{}
+	}
+	return s
+}
+
+func (cache *totalOrderingObjectCache) recycleAckedStatus(
+	s []*totalOrderingHeightRecord) {
+	for _, rec := range s {
+		rec.minHeight, rec.count = 0, 0
+	}
+	cache.ackedStatusPool = append(cache.ackedStatusPool, s)
+}
+
+func (cache *totalOrderingObjectCache) requestHeightVector() []uint64 {
+	if n := len(cache.heightVecPool); n > 0 {
+		s := cache.heightVecPool[n-1]
+		cache.heightVecPool = cache.heightVecPool[:n-1]
+		return s
+	}
+	return make([]uint64, cache.numChains)
+}
+
+func (cache *totalOrderingObjectCache) recycleHeightVector(s []uint64) {
+	cache.heightVecPool = append(cache.heightVecPool, s)
+}
+
+func (cache *totalOrderingObjectCache) requestWinRecords() []*totalOrderingWinRecord {
+	if n := len(cache.winRecordsPool); n > 0 {
+		s := cache.winRecordsPool[n-1]
+		cache.winRecordsPool = cache.winRecordsPool[:n-1]
+		return s
+	}
+	return make([]*totalOrderingWinRecord, cache.numChains)
+}
+
+func (cache *totalOrderingObjectCache) recycleWinRecords(
+	s []*totalOrderingWinRecord) {
+	for i := range s {
+		s[i] = nil
+	}
+	cache.winRecordsPool = append(cache.winRecordsPool, s)
+}
+
+// protocolPhiRatio is the BFT agreement threshold (ceil(2N/3)) used to
+// derive the phi count once K/PhiRatio/NumChains are no longer sourced from
+// governance.
+const protocolPhiRatio = float64(2) / float64(3)
+
+// defaultTotalOrderingK is the starting K used when it isn't explicitly
+// configured; it's then auto-tuned upward from the observed acking depth
+// of the DAG (see (*totalOrdering).observeAckDepth).
+const defaultTotalOrderingK = uint64(0)
+
+// totalOrderingConfig is the per-round configuration used by totalOrdering.
+// NumChains, K and PhiRatio are derived internally by default: NumChains is
+// observed from the highest acked ChainID seen in the round, PhiRatio is
+// the fixed protocol constant, and K is auto-tuned from measured acking
+// depth. types.Config's K/PhiRatio/NumChains fields are deprecated but are
+// still honored verbatim when set to a non-zero value, to give governance a
+// migration path.
+type totalOrderingConfig struct {
+	k                 uint64
+	phi               float32
+	numChains         uint32
+	roundInterval     time.Duration
+	explicitNumChains bool
+	explicitK         bool
+	explicitPhi       bool
+}
+
+func newTotalOrderingConfig(cfg *types.Config) *totalOrderingConfig {
+	tc := &totalOrderingConfig{
+		roundInterval: cfg.RoundInterval,
+		k:             defaultTotalOrderingK,
+	}
+	if cfg.NumChains != 0 {
+		tc.numChains = cfg.NumChains
+		tc.explicitNumChains = true
+	}
+	if cfg.K != 0 {
+		tc.k = uint64(cfg.K)
+		tc.explicitK = true
+	}
+	if cfg.PhiRatio != 0 {
+		tc.phi = float32(math.Ceil(float64(cfg.PhiRatio) * float64(tc.numChains)))
+		tc.explicitPhi = true
+	} else {
+		tc.phi = float32(math.Ceil(protocolPhiRatio * float64(tc.numChains)))
+	}
+	return tc
+}
+
+// totalOrdering implements the DEXON total ordering algorithm: it accepts
+// blocks forming a DAG (via their Acks) and delivers them in batches, each
+// batch internally ordered by hash.
+type totalOrdering struct {
+	pendings              map[common.Hash]*types.Block
+	acked                 map[common.Hash]map[common.Hash]struct{}
+	candidates            map[uint32]*totalOrderingCandidateInfo
+	candidateChainMapping map[uint32]common.Hash
+	configs               map[uint64]*totalOrderingConfig
+	objCache              *totalOrderingObjectCache
+	curRound              uint64
+	roundBeginTime        time.Time
+	roundBegun            map[uint64]struct{}
+	byProposer            bool
+	chainIndex            map[types.NodeID]uint32
+	parallelism           int
+}
+
+// TotalOrderingConfig holds process-local tuning knobs for totalOrdering
+// that aren't part of on-chain governance (see types.Config) and must
+// therefore never be serialized via Snapshot/LoadTotalOrdering or compared
+// across nodes.
+type TotalOrderingConfig struct {
+	// Parallelism is the number of worker goroutines refreshCandidates
+	// shards its per-chain bookkeeping across, via forEachChain. Values <= 1
+	// run serially.
+	Parallelism int
+}
+
+// defaultTotalOrderingParallelism is the parallelism used until
+// SetParallelism is called: fully serial, matching the algorithm's
+// historical single-threaded behavior.
+const defaultTotalOrderingParallelism = 1
+
+// SetParallelism overrides the worker pool size used to shard per-chain
+// candidate bookkeeping in refreshCandidates. It's process-local tuning, not
+// governance, so it must be set freshly on every instance that wants it
+// (including ones restored via LoadTotalOrdering).
+func (to *totalOrdering) SetParallelism(cfg TotalOrderingConfig) {
+	if cfg.Parallelism > 1 {
+		to.parallelism = cfg.Parallelism
+	} else {
+		to.parallelism = defaultTotalOrderingParallelism
+	}
+}
+
+// newTotalOrdering creates a chain-indexed totalOrdering instance, i.e. the
+// candidate and acked-status bookkeeping is keyed by the block's
+// Position.ChainID. NumChains is no longer required up front: it's observed
+// from the highest ChainID seen in the round (see growNumChainsIfNeeded)
+// unless explicitly governed.
+func newTotalOrdering(
+	genesisTime time.Time, round uint64, cfg *types.Config) *totalOrdering {
+	to := &totalOrdering{
+		pendings:              make(map[common.Hash]*types.Block),
+		acked:                 make(map[common.Hash]map[common.Hash]struct{}),
+		candidates:            make(map[uint32]*totalOrderingCandidateInfo),
+		candidateChainMapping: make(map[uint32]common.Hash),
+		configs:               make(map[uint64]*totalOrderingConfig),
+		curRound:              round,
+		roundBeginTime:        genesisTime,
+		roundBegun:            make(map[uint64]struct{}),
+		parallelism:           defaultTotalOrderingParallelism,
+	}
+	to.configs[round] = newTotalOrderingConfig(cfg)
+	to.objCache = newTotalOrderingObjectCache(to.configs[round].numChains)
+	return to
+}
+
+// newTotalOrderingByProposer creates a totalOrdering instance that doesn't
+// rely on a pre-declared NumChains: candidate/acked-status slots are keyed
+// by a compact index assigned the first time a proposer's block is seen,
+// rather than by Position.ChainID. This lets total ordering run against a
+// validator-set model instead of a chain-count model.
+func newTotalOrderingByProposer(
+	genesisTime time.Time, round uint64, cfg *types.Config) *totalOrdering {
+	to := newTotalOrdering(genesisTime, round, cfg)
+	to.byProposer = true
+	to.chainIndex = make(map[types.NodeID]uint32)
+	return to
+}
+
+// appendConfig adds a config for an upcoming round. Rounds must be appended
+// in order, one at a time, immediately following the last appended round.
+func (to *totalOrdering) appendConfig(round uint64, cfg *types.Config) error {
+	if round == 0 {
+		return ErrRoundAlreadyPast
+	}
+	if _, exists := to.configs[round]; exists {
+		return ErrRoundAlreadyPast
+	}
+	if _, exists := to.configs[round-1]; !exists {
+		return ErrRoundNotAppended
+	}
+	to.configs[round] = newTotalOrderingConfig(cfg)
+	return nil
+}
+
+// ErrRoundAlreadyBegun is reported by updateRoundConfig when a block
+// belonging to the round has already been processed.
+var ErrRoundAlreadyBegun = fmt.Errorf(
+	"total ordering: round has already begun")
+
+// updateRoundConfig overwrites the K and PhiRatio of an already-appended
+// future round, as long as no block of that round has been processed yet.
+// This lets governance tune ordering aggressiveness for an upcoming round
+// without requiring a chain halt.
+func (to *totalOrdering) updateRoundConfig(
+	round uint64, newCfg *types.Config) error {
+	if _, exists := to.configs[round]; !exists {
+		return ErrRoundNotAppended
+	}
+	if _, begun := to.roundBegun[round]; begun {
+		return ErrRoundAlreadyBegun
+	}
+	to.configs[round] = newTotalOrderingConfig(newCfg)
+	return nil
+}
+
+// curConfig returns the config for the current round.
+func (to *totalOrdering) curConfig() *totalOrderingConfig {
+	return to.configs[to.curRound]
+}
+
+// chainIDOf returns the compact chain/proposer index used to key candidate
+// and acked-status slots for the given block.
+func (to *totalOrdering) chainIDOf(b *types.Block) uint32 {
+	if !to.byProposer {
+		return b.Position.ChainID
+	}
+	if idx, exists := to.chainIndex[b.ProposerID]; exists {
+		return idx
+	}
+	idx := uint32(len(to.chainIndex))
+	to.chainIndex[b.ProposerID] = idx
+	return idx
+}
+
+// switchRound advances curRound by one, assuming processBlock has delivered
+// everything belonging to the current round. If the new round's NumChains
+// differs from the object cache's sizing, the cache is rebuilt so no
+// wrongly-sized recycled slice from the old round can be handed out.
+func (to *totalOrdering) switchRound() {
+	to.curRound++
+	if cfg, exists := to.configs[to.curRound]; exists &&
+		cfg.numChains != to.objCache.numChains {
+		to.objCache = newTotalOrderingObjectCache(cfg.numChains)
+	}
+}
+
+// processBlock feeds one block into the total ordering algorithm. It
+// returns the set of blocks that became deliverable (already sorted by
+// hash), the mode that produced them, and any error.
+func (to *totalOrdering) processBlock(
+	b *types.Block) ([]*types.Block, uint32, error) {
+	if _, exists := to.pendings[b.Hash]; exists {
+		return nil, TotalOrderingModeNormal, nil
+	}
+	to.pendings[b.Hash] = b
+	to.roundBegun[b.Position.Round] = struct{}{}
+	to.propagateAcks(b)
+
+	chainID := to.chainIDOf(b)
+	to.growNumChainsIfNeeded(chainID)
+	if _, exists := to.candidateChainMapping[chainID]; !exists {
+		to.promoteCandidate(chainID, b.Hash)
+	}
+
+	to.refreshCandidates()
+	delivered, mode := to.pickDeliverable()
+	return delivered, mode, nil
+}
+
+// propagateAcks records that b acks every hash in b.Acks, and transitively
+// propagates that relationship to anything those hashes (still pending)
+// themselves ack, guarding against cycles in malformed input. The deepest
+// transitive ack chain walked is fed into observeAckDepth, so K can be
+// auto-tuned from the DAG's measured depth when it isn't explicitly
+// governed.
+func (to *totalOrdering) propagateAcks(b *types.Block) {
+	visited := make(map[common.Hash]struct{})
+	var maxDepth uint64
+	var walk func(h common.Hash, depth uint64)
+	walk = func(h common.Hash, depth uint64) {
+		if h == b.Hash {
+			// A block acking itself, directly or through a cycle: ignore.
+			return
+		}
+		if _, exists := visited[h]; exists {
+			return
+		}
+		visited[h] = struct{}{}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		if to.acked[h] == nil {
+			to.acked[h] = make(map[common.Hash]struct{})
+		}
+		to.acked[h][b.Hash] = struct{}{}
+		ancestor, exists := to.pendings[h]
+		if !exists {
+			return
+		}
+		for _, ack := range ancestor.Acks {
+			walk(ack, depth+1)
+		}
+	}
+	for _, h := range b.Acks {
+		walk(h, 1)
+	}
+	to.observeAckDepth(maxDepth)
+}
+
+// growNumChainsIfNeeded ensures the current round's NumChains covers
+// chainID, auto-growing it (and phi alongside it, unless phi is explicitly
+// governed) when NumChains isn't explicitly governed. Existing candidates'
+// per-chain slices are padded to match.
+func (to *totalOrdering) growNumChainsIfNeeded(chainID uint32) {
+	cfg := to.curConfig()
+	if cfg.explicitNumChains || chainID < cfg.numChains {
+		return
+	}
+	newNumChains := chainID + 1
+	cfg.numChains = newNumChains
+	if !cfg.explicitPhi {
+		cfg.phi = float32(math.Ceil(protocolPhiRatio * float64(newNumChains)))
+	}
+	if newNumChains > to.objCache.numChains {
+		to.objCache = newTotalOrderingObjectCache(newNumChains)
+	}
+	for _, info := range to.candidates {
+		for uint32(len(info.ackedStatus)) < newNumChains {
+			info.ackedStatus = append(
+				info.ackedStatus, &totalOrderingHeightRecord{})
+			info.cachedHeightVector = append(info.cachedHeightVector, 0)
+			info.winRecords = append(info.winRecords, nil)
+		}
+		for _, rec := range info.winRecords {
+			for rec != nil && uint32(len(rec.wins)) < newNumChains {
+				rec.wins = append(rec.wins, false)
+			}
+		}
+	}
+}
+
+// observeAckDepth feeds a newly observed transitive acking depth into K's
+// rolling estimate, used to auto-tune K from measured network diameter when
+// it isn't explicitly governed.
+func (to *totalOrdering) observeAckDepth(depth uint64) {
+	cfg := to.curConfig()
+	if cfg.explicitK || depth <= cfg.k {
+		return
+	}
+	cfg.k = depth
+}
+
+// promoteCandidate registers the earliest pending block on chainID as the
+// chain's current candidate.
+func (to *totalOrdering) promoteCandidate(chainID uint32, hash common.Hash) {
+	to.candidateChainMapping[chainID] = hash
+	to.candidates[chainID] = newTotalOrderingCandidateInfo(hash, to.objCache)
+}
+
+// refreshCandidates recomputes every candidate's acked-status, height
+// vector and win records against the others. Each candidate only ever
+// writes to its own ackedStatus/cachedHeightVector/winRecords, so the three
+// per-candidate passes below are embarrassingly parallel across chains and
+// are sharded onto to.parallelism workers via forEachChain. The "global"
+// reference in between is the one step that genuinely needs every
+// candidate's freshly recomputed ackedStatus at once, so it stays a plain
+// serialized reduction.
+func (to *totalOrdering) refreshCandidates() {
+	cfg := to.curConfig()
+	dirty := make([]int, cfg.numChains)
+	for i := range dirty {
+		dirty[i] = i
+	}
+	chainIDs := make([]uint32, 0, len(to.candidates))
+	for chainID := range to.candidates {
+		chainIDs = append(chainIDs, chainID)
+	}
+
+	// Recompute ackedStatus for each candidate from the current acked map.
+	to.forEachChain(chainIDs, func(chainID uint32) {
+		info := to.candidates[chainID]
+		for _, rec := range info.ackedStatus {
+			rec.minHeight, rec.count = 0, 0
+		}
+		ackers := to.acked[to.candidateChainMapping[chainID]]
+		heights := make(map[uint32][]uint64)
+		for h := range ackers {
+			ackerBlock, exists := to.pendings[h]
+			if !exists {
+				continue
+			}
+			ackerChain := to.chainIDOf(ackerBlock)
+			heights[ackerChain] = append(
+				heights[ackerChain], ackerBlock.Position.Height)
+		}
+		for ackerChain, hs := range heights {
+			if int(ackerChain) >= len(info.ackedStatus) {
+				continue
+			}
+			sort.Slice(hs, func(i, j int) bool { return hs[i] < hs[j] })
+			info.ackedStatus[ackerChain] = &totalOrderingHeightRecord{
+				minHeight: hs[0],
+				count:     uint64(len(hs)),
+			}
+		}
+	})
+
+	// A synthetic "global" reference: the widest ackedStatus seen across all
+	// candidates on each chain, used as the baseline for K-distance checks.
+	// This is the serialized reduction step: it folds every candidate's
+	// ackedStatus together, so it can't be sharded like the passes around it.
+	global := newTotalOrderingCandidateInfo(common.Hash{}, to.objCache)
+	for _, info := range to.candidates {
+		for i, rec := range info.ackedStatus {
+			if rec.count == 0 {
+				continue
+			}
+			if global.ackedStatus[i].count == 0 ||
+				rec.minHeight < global.ackedStatus[i].minHeight {
+				global.ackedStatus[i] = rec
+			}
+		}
+	}
+
+	to.forEachChain(chainIDs, func(chainID uint32) {
+		to.candidates[chainID].updateAckingHeightVector(
+			global, cfg.k, dirty, to.objCache)
+	})
+
+	to.forEachChain(chainIDs, func(chainID uint32) {
+		info := to.candidates[chainID]
+		for otherChainID, other := range to.candidates {
+			if chainID == otherChainID {
+				continue
+			}
+			info.updateWinRecord(
+				otherChainID, other, dirty, to.objCache, cfg.numChains)
+		}
+	})
+}
+
+// forEachChain runs fn once per entry in chainIDs, sharding the work across
+// to.parallelism worker goroutines when parallelism is configured above 1.
+// It's only safe to use this way because every fn passed in from
+// refreshCandidates touches just the one candidate keyed by its chainID
+// argument, so workers never contend on the same state; forEachChain itself
+// is the barrier that waits for every shard to finish. Falls back to a
+// plain serial loop when parallelism is left at its default, so this is a
+// no-op change to the historical single-threaded behavior until a caller
+// opts in via SetParallelism.
+func (to *totalOrdering) forEachChain(chainIDs []uint32, fn func(chainID uint32)) {
+	if to.parallelism <= 1 || len(chainIDs) <= 1 {
+		for _, chainID := range chainIDs {
+			fn(chainID)
+		}
+		return
+	}
+	workers := to.parallelism
+	if workers > len(chainIDs) {
+		workers = len(chainIDs)
+	}
+	jobs := make(chan uint32, len(chainIDs))
+	for _, chainID := range chainIDs {
+		jobs <- chainID
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for chainID := range jobs {
+				fn(chainID)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// pickDeliverable delivers, sorted by hash, every candidate whose grade
+// against each other candidate is never -1. The mode is
+// TotalOrderingModeNormal when every delivered candidate's acking node set
+// spans all chains, and TotalOrderingModeEarly otherwise.
+func (to *totalOrdering) pickDeliverable() ([]*types.Block, uint32) {
+	cfg := to.curConfig()
+	var winners []uint32
+Candidates:
+	for chainID, info := range to.candidates {
+		for otherChainID, other := range to.candidates {
+			if chainID == otherChainID {
+				continue
+			}
+			rec := info.winRecords[otherChainID]
+			if rec == nil {
+				continue
+			}
+			if rec.grade(cfg.numChains, cfg.phi, uint64(len(to.candidates))) < 0 {
+				continue Candidates
+			}
+			_ = other
+		}
+		winners = append(winners, chainID)
+	}
+	if len(winners) == 0 {
+		return nil, TotalOrderingModeNormal
+	}
+	mode := uint32(TotalOrderingModeNormal)
+	full := true
+	for _, chainID := range winners {
+		if to.candidates[chainID].getAckingNodeSetLength(
+			to.candidates[chainID], cfg.k, cfg.numChains) < uint64(cfg.numChains) {
+			full = false
+		}
+	}
+	if !full {
+		mode = TotalOrderingModeEarly
+	}
+
+	hashes := make(common.Hashes, 0, len(winners))
+	blocks := make([]*types.Block, 0, len(winners))
+	for _, chainID := range winners {
+		hash := to.candidateChainMapping[chainID]
+		hashes = append(hashes, hash)
+		blocks = append(blocks, to.pendings[hash])
+		delete(to.pendings, hash)
+		delete(to.candidateChainMapping, chainID)
+		delete(to.acked, hash)
+		to.objCache.recycleAckedStatus(to.candidates[chainID].ackedStatus)
+		to.objCache.recycleHeightVector(to.candidates[chainID].cachedHeightVector)
+		to.objCache.recycleWinRecords(to.candidates[chainID].winRecords)
+		delete(to.candidates, chainID)
+	}
+	sort.Sort(hashes)
+	sorted := make([]*types.Block, len(blocks))
+	for i, h := range hashes {
+		for _, blk := range blocks {
+			if blk.Hash == h {
+				sorted[i] = blk
+				break
+			}
+		}
+	}
+
+	// Promote the next pending block (if any) on each chain that just lost
+	// its candidate.
+	for _, chainID := range winners {
+		to.promoteNext(chainID)
+	}
+
+	return sorted, mode
+}
+
+// promoteNext picks the lowest-height pending block on chainID, if any, to
+// be its next candidate.
+func (to *totalOrdering) promoteNext(chainID uint32) {
+	var next *types.Block
+	for _, b := range to.pendings {
+		if to.chainIDOf(b) != chainID {
+			continue
+		}
+		if next == nil || b.Position.Height < next.Position.Height {
+			next = b
+		}
+	}
+	if next != nil {
+		to.promoteCandidate(chainID, next.Hash)
+	}
+}
+
+// FlushBoundary reports the highest round that's currently safe to flush,
+// i.e. the most recent round curRound has already rotated past, and whether
+// any such round exists yet. A caller (e.g. TotalOrderingSyncer or the
+// consensus layer) polls this to know when it can cut over from a
+// processBlock-driven deliver stream to an explicit Flush call at a round
+// boundary.
+func (to *totalOrdering) FlushBoundary() (uint64, bool) {
+	if to.curRound == 0 {
+		return 0, false
+	}
+	return to.curRound - 1, true
+}
+
+// Flush force-delivers every pending candidate belonging to a round at or
+// before roundID, regardless of whether it has accumulated enough acks to
+// win normally, and returns them grouped and sorted per round, in round
+// order. roundID must already be behind FlushBoundary, so this can only
+// rewrite history that processBlock itself would never deliver out of order
+// with what's still to come.
+func (to *totalOrdering) Flush(roundID uint64) ([][]*types.Block, error) {
+	if boundary, ok := to.FlushBoundary(); !ok || roundID > boundary {
+		return nil, ErrRoundNotPast
+	}
+	byRound := make(map[uint64][]*types.Block)
+	for {
+		var flushable []uint32
+		for chainID, hash := range to.candidateChainMapping {
+			if to.pendings[hash].Position.Round <= roundID {
+				flushable = append(flushable, chainID)
+			}
+		}
+		if len(flushable) == 0 {
+			break
+		}
+		for _, chainID := range flushable {
+			hash := to.candidateChainMapping[chainID]
+			b := to.pendings[hash]
+			byRound[b.Position.Round] = append(byRound[b.Position.Round], b)
+			delete(to.pendings, hash)
+			delete(to.candidateChainMapping, chainID)
+			delete(to.acked, hash)
+			to.objCache.recycleAckedStatus(to.candidates[chainID].ackedStatus)
+			to.objCache.recycleHeightVector(to.candidates[chainID].cachedHeightVector)
+			to.objCache.recycleWinRecords(to.candidates[chainID].winRecords)
+			delete(to.candidates, chainID)
+			to.promoteNext(chainID)
+		}
+	}
+	rounds := make([]uint64, 0, len(byRound))
+	for round := range byRound {
+		rounds = append(rounds, round)
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] < rounds[j] })
+	result := make([][]*types.Block, len(rounds))
+	for i, round := range rounds {
+		roundBlocks := byRound[round]
+		hashes := make(common.Hashes, 0, len(roundBlocks))
+		for _, b := range roundBlocks {
+			hashes = append(hashes, b.Hash)
+		}
+		sort.Sort(hashes)
+		sorted := make([]*types.Block, len(hashes))
+		for hi, h := range hashes {
+			for _, b := range roundBlocks {
+				if b.Hash == h {
+					sorted[hi] = b
+					break
+				}
+			}
+		}
+		result[i] = sorted
+	}
+	return result, nil
+}
@@ -1115,7 +1115,11 @@ func (s *TotalOrderingTestSuite) baseTestForRoundChange(
 }
 
 func (s *TotalOrderingTestSuite) TestNumChainsChanged() {
-	// This test fixes K, Phi, and changes 'numChains' for each round.
+	// NumChains is no longer a governed parameter: it's observed from the
+	// highest ChainID acked within a round. This test fixes K and Phi, grows
+	// and shrinks how many chains the DAG generator produces each round, and
+	// makes sure totalOrdering tracks the chain count on its own, without
+	// ever being told what it is.
 	fix := func(c *types.Config) *types.Config {
 		c.K = 1
 		c.PhiRatio = 0.5
@@ -1124,20 +1128,58 @@ func (s *TotalOrderingTestSuite) TestNumChainsChanged() {
 		return c
 	}
 	var (
-		repeat  = 7
-		configs = []*types.Config{
-			fix(&types.Config{NumChains: 7}),
-			fix(&types.Config{NumChains: 10}),
-			fix(&types.Config{NumChains: 4}),
-			fix(&types.Config{NumChains: 13}),
-			fix(&types.Config{NumChains: 4}),
-		}
+		req          = s.Require()
+		genesisTime  = time.Now().UTC()
+		repeat       = 7
+		genNumChains = []uint32{7, 10, 4, 13, 4}
+		genConfigs   = make([]*types.Config, len(genNumChains))
 	)
-	s.baseTestForRoundChange(repeat, configs)
+	for i, n := range genNumChains {
+		genConfigs[i] = fix(&types.Config{NumChains: n})
+	}
+	dbInst, err := db.NewMemBackedDB()
+	req.NoError(err)
+	// Generate DAG for rounds, one chain count per round.
+	// NOTE: the last config won't be tested, just avoid panic
+	//       when round switching.
+	begin := genesisTime
+	for roundID, config := range genConfigs[:len(genConfigs)-1] {
+		gen := test.NewBlocksGenerator(
+			test.NewBlocksGeneratorConfig(config), nil, hashBlock)
+		end := begin.Add(config.RoundInterval)
+		req.NoError(gen.Generate(uint64(roundID), begin, end, dbInst))
+		begin = end
+	}
+	iter, err := dbInst.GetAllBlocks()
+	req.NoError(err)
+	revealer, err := test.NewRandomDAGBlockRevealer(iter)
+	req.NoError(err)
+	// Strip NumChains before handing the configs to totalOrdering: it must
+	// derive the chain count from the acked set, not from governance.
+	configs := make([]*types.Config, len(genConfigs))
+	for i, genConfig := range genConfigs {
+		c := *genConfig
+		c.NumChains = 0
+		configs[i] = &c
+	}
+	revealingSequence := make(map[string]struct{})
+	orderingSequence := make(map[string]struct{})
+	for i := 0; i < repeat; i++ {
+		to := newTotalOrdering(genesisTime, 0, configs[0])
+		for roundID, config := range configs[1:] {
+			req.NoError(to.appendConfig(uint64(roundID+1), config))
+		}
+		revealed, ordered := s.performOneRun(to, revealer)
+		revealingSequence[revealed] = struct{}{}
+		orderingSequence[ordered] = struct{}{}
+	}
+	s.checkRandomResult(revealingSequence, orderingSequence)
 }
 
 func (s *TotalOrderingTestSuite) TestPhiChanged() {
-	// This test fixes K, numChains, and changes Phi each round.
+	// This test fixes K, numChains, and changes Phi each round. All three
+	// are still honored explicitly here, exercising the deprecated-but-
+	// honored migration path.
 	fix := func(c *types.Config) *types.Config {
 		c.K = 1
 		c.NumChains = 10
@@ -1159,7 +1201,10 @@ func (s *TotalOrderingTestSuite) TestPhiChanged() {
 }
 
 func (s *TotalOrderingTestSuite) TestKChanged() {
-	// This test fixes phi, numChains, and changes K each round.
+	// This test fixes phi, numChains, and changes K each round. phi and
+	// numChains are honored explicitly here, exercising the deprecated-but-
+	// honored migration path; K is honored explicitly in the rounds that set
+	// it non-zero, and auto-tuned in the rounds with K: 0.
 	fix := func(c *types.Config) *types.Config {
 		c.NumChains = 10
 		c.PhiRatio = 0.7
@@ -1181,7 +1226,10 @@ func (s *TotalOrderingTestSuite) TestKChanged() {
 }
 
 func (s *TotalOrderingTestSuite) TestRoundChanged() {
-	// This test changes everything when round changed.
+	// This test changes everything when round changed, still declaring
+	// NumChains and PhiRatio explicitly to exercise the deprecated-but-
+	// honored migration path. K is declared explicitly in the rounds that set
+	// it non-zero, and auto-tuned in the rounds with K: 0.
 	fix := func(c *types.Config) *types.Config {
 		c.MinBlockInterval = 250 * time.Millisecond
 		c.RoundInterval = 10 * time.Second
@@ -1422,6 +1470,311 @@ func (s *TotalOrderingTestSuite) TestSyncWithConfigChange() {
 	}
 }
 
+func (s *TotalOrderingTestSuite) TestByProposerBasic() {
+	// Same DAG shape as TestBasicCaseForK2's early layers, but built with
+	// newTotalOrderingByProposer: Position.ChainID is left zeroed on every
+	// block, and the algorithm must still key acking status by proposer
+	// identity rather than falling over without a declared NumChains.
+	nodes := test.GenerateRandomNodeIDs(5)
+	genesisConfig := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             0,
+		PhiRatio:      0.5,
+	}
+	genesisTime := time.Now().UTC()
+	to := newTotalOrderingByProposer(genesisTime, 0, genesisConfig)
+	req := s.Require()
+
+	genGenesis := func(proposer types.NodeID, acks common.Hashes) *types.Block {
+		return &types.Block{
+			ProposerID: proposer,
+			Hash:       common.NewRandomHash(),
+			Acks:       common.NewSortedHashes(acks),
+		}
+	}
+	genNext := func(b *types.Block) *types.Block {
+		return &types.Block{
+			ProposerID: b.ProposerID,
+			ParentHash: b.Hash,
+			Hash:       common.NewRandomHash(),
+			Acks:       common.NewSortedHashes(common.Hashes{b.Hash}),
+		}
+	}
+
+	b0 := genGenesis(nodes[0], common.Hashes{})
+	_, _, err := to.processBlock(b0)
+	req.NoError(err)
+
+	b1 := genGenesis(nodes[1], common.Hashes{b0.Hash})
+	_, _, err = to.processBlock(b1)
+	req.NoError(err)
+
+	// b0 is now acked by a proposer distinct from its own, tracked by
+	// identity rather than by any ChainID slot (every block here has
+	// ChainID 0).
+	req.Contains(to.acked[b0.Hash], b1.Hash)
+
+	b2 := genNext(b1)
+	_, _, err = to.processBlock(b2)
+	req.NoError(err)
+	req.Equal(uint32(0), b2.Position.ChainID)
+	req.Equal(uint32(0), b1.Position.ChainID)
+}
+
+func (s *TotalOrderingTestSuite) TestSnapshotRestore() {
+	// Build four blocks on each of five chains, feed them into a baseline
+	// instance start-to-finish, and into a second instance that snapshots
+	// midway and resumes from a freshly loaded copy. Both must deliver the
+	// exact same sequence.
+	nodes := test.GenerateRandomNodeIDs(5)
+	genesisConfig := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             1,
+		PhiRatio:      0.6,
+		NumChains:     uint32(len(nodes)),
+	}
+	req := s.Require()
+	genesisTime := time.Now().UTC()
+
+	var blocks []*types.Block
+	genNext := func(b *types.Block) *types.Block {
+		return &types.Block{
+			ProposerID: b.ProposerID,
+			ParentHash: b.Hash,
+			Hash:       common.NewRandomHash(),
+			Position: types.Position{
+				Height:  b.Position.Height + 1,
+				ChainID: b.Position.ChainID,
+			},
+			Acks: common.NewSortedHashes(common.Hashes{b.Hash}),
+		}
+	}
+	for chainID := uint32(0); chainID < uint32(len(nodes)); chainID++ {
+		b := s.genGenesisBlock(nodes, chainID, common.Hashes{})
+		blocks = append(blocks, b)
+		for i := 0; i < 3; i++ {
+			b = genNext(b)
+			blocks = append(blocks, b)
+		}
+	}
+
+	baseline := newTotalOrdering(genesisTime, 0, genesisConfig)
+	var baselineDelivered common.Hashes
+	for _, b := range blocks {
+		delivered, _, err := baseline.processBlock(b)
+		req.NoError(err)
+		for _, d := range delivered {
+			baselineDelivered = append(baselineDelivered, d.Hash)
+		}
+	}
+
+	resumable := newTotalOrdering(genesisTime, 0, genesisConfig)
+	var resumedDelivered common.Hashes
+	midpoint := len(blocks) / 2
+	for _, b := range blocks[:midpoint] {
+		delivered, _, err := resumable.processBlock(b)
+		req.NoError(err)
+		for _, d := range delivered {
+			resumedDelivered = append(resumedDelivered, d.Hash)
+		}
+	}
+
+	snapshotBytes, err := resumable.Snapshot()
+	req.NoError(err)
+	restored, err := LoadTotalOrdering(snapshotBytes, genesisConfig)
+	req.NoError(err)
+
+	for _, b := range blocks[midpoint:] {
+		delivered, _, err := restored.processBlock(b)
+		req.NoError(err)
+		for _, d := range delivered {
+			resumedDelivered = append(resumedDelivered, d.Hash)
+		}
+	}
+
+	req.Equal(baselineDelivered, resumedDelivered)
+}
+
+func (s *TotalOrderingTestSuite) TestUpdateRoundConfig() {
+	nodes := test.GenerateRandomNodeIDs(5)
+	genesisConfig := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             2,
+		PhiRatio:      0.6,
+		NumChains:     uint32(len(nodes)),
+	}
+	round1Config := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             1,
+		PhiRatio:      0.5,
+		NumChains:     uint32(len(nodes)),
+	}
+	genesisTime := time.Now().UTC()
+	req := s.Require()
+
+	to := newTotalOrdering(genesisTime, 0, genesisConfig)
+	req.NoError(to.appendConfig(1, genesisConfig))
+	// Mutate round 1's config before any round-1 block has been processed.
+	req.NoError(to.updateRoundConfig(1, round1Config))
+
+	b0 := s.genGenesisBlock(nodes, 0, common.Hashes{})
+	_, _, err := to.processBlock(b0)
+	req.NoError(err)
+
+	// Once a block of the round has been processed, the config is frozen.
+	req.Error(to.updateRoundConfig(0, round1Config))
+
+	to.switchRound()
+	req.Equal(uint64(round1Config.K), to.curConfig().k)
+
+	// A fresh instance configured with round1Config from the start should
+	// agree on the same K/Phi once it reaches the equivalent round.
+	fresh := newTotalOrdering(genesisTime, 1, round1Config)
+	req.Equal(to.curConfig().k, fresh.curConfig().k)
+	req.Equal(to.curConfig().phi, fresh.curConfig().phi)
+}
+
+func (s *TotalOrderingTestSuite) TestFlush() {
+	// Build several chains' genesis blocks that ack nothing, so none would
+	// ever accumulate enough peer acks to win normally, then force them out
+	// via Flush once curRound has moved past their round.
+	nodes := test.GenerateRandomNodeIDs(5)
+	genesisConfig := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             0,
+		PhiRatio:      0.6,
+		NumChains:     uint32(len(nodes)),
+	}
+	genesisTime := time.Now().UTC()
+	req := s.Require()
+
+	to := newTotalOrdering(genesisTime, 0, genesisConfig)
+	req.NoError(to.appendConfig(1, genesisConfig))
+
+	_, ok := to.FlushBoundary()
+	req.False(ok)
+
+	var genesisBlocks []*types.Block
+	for chainID := uint32(0); chainID < uint32(len(nodes)); chainID++ {
+		b := s.genGenesisBlock(nodes, chainID, common.Hashes{})
+		genesisBlocks = append(genesisBlocks, b)
+		delivered, _, err := to.processBlock(b)
+		req.NoError(err)
+		req.Empty(delivered)
+	}
+
+	to.switchRound()
+	boundary, ok := to.FlushBoundary()
+	req.True(ok)
+	req.Equal(uint64(0), boundary)
+
+	_, err := to.Flush(boundary + 1)
+	req.Equal(ErrRoundNotPast, err)
+
+	delivered, err := to.Flush(boundary)
+	req.NoError(err)
+	req.Len(delivered, 1)
+	req.Len(delivered[0], len(genesisBlocks))
+	req.Empty(to.candidates)
+	req.Empty(to.pendings)
+
+	// Flushing again finds nothing left to deliver.
+	delivered, err = to.Flush(boundary)
+	req.NoError(err)
+	req.Empty(delivered)
+}
+
+func (s *TotalOrderingTestSuite) TestTotalOrderingSyncer() {
+	var (
+		req         = s.Require()
+		numChains   = uint32(13)
+		genesisTime = time.Now().UTC()
+	)
+	gen := test.NewBlocksGenerator(&test.BlocksGeneratorConfig{
+		NumChains:            numChains,
+		MinBlockTimeInterval: 250 * time.Millisecond,
+	}, nil, hashBlock)
+	dbInst, err := db.NewMemBackedDB()
+	req.NoError(err)
+	err = gen.Generate(0, genesisTime, genesisTime.Add(10*time.Second), dbInst)
+	req.NoError(err)
+	iter, err := dbInst.GetAllBlocks()
+	req.NoError(err)
+	revealer, err := test.NewRandomDAGBlockRevealer(iter)
+	req.NoError(err)
+
+	var blocks []*types.Block
+	for {
+		b, err := revealer.NextBlock()
+		if err != nil {
+			if err == db.ErrIterationFinished {
+				err = nil
+				break
+			}
+		}
+		req.NoError(err)
+		blocks = append(blocks, &b)
+	}
+
+	genesisConfig := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             0,
+		PhiRatio:      0.67,
+		NumChains:     numChains,
+	}
+
+	// Baseline: a single totalOrdering fed every block from genesis.
+	baseline := newTotalOrdering(genesisTime, 0, genesisConfig)
+	var baselineDelivered [][]*types.Block
+	for _, b := range blocks {
+		bs, _, err := baseline.processBlock(b)
+		req.NoError(err)
+		if len(bs) > 0 {
+			baselineDelivered = append(baselineDelivered, bs)
+		}
+	}
+
+	// Syncer: probes until it observes a safe cut, then drives a live
+	// totalOrdering directly. Sync doesn't surface the one delivered batch
+	// produced by the cutover call itself, so we expect every later
+	// delivered batch to exactly match the corresponding tail of the
+	// baseline run.
+	syncer := NewTotalOrderingSyncer(genesisTime, 0, genesisConfig)
+	var syncerDelivered [][]*types.Block
+	var ready bool
+	for i, b := range blocks {
+		ready, err = syncer.Sync(b)
+		req.NoError(err)
+		if ready {
+			req.NotNil(syncer.Consensus())
+			for _, rest := range blocks[i+1:] {
+				bs, _, err := syncer.Consensus().processBlock(rest)
+				req.NoError(err)
+				if len(bs) > 0 {
+					syncerDelivered = append(syncerDelivered, bs)
+				}
+			}
+			break
+		}
+	}
+	req.True(ready)
+	req.NotEmpty(syncerDelivered)
+
+	// If the cutover had discarded the probe's in-flight candidates instead
+	// of promoting it directly into the live instance, the chains still
+	// holding undelivered candidates at that moment would be orphaned from
+	// their ancestors and the tail below would diverge in length and
+	// content instead of merely being offset by the one swallowed batch.
+	offset := len(baselineDelivered) - len(syncerDelivered)
+	req.True(offset >= 0)
+	for i, bs := range syncerDelivered {
+		req.Equal(len(baselineDelivered[offset+i]), len(bs))
+		for j, b := range bs {
+			req.Equal(baselineDelivered[offset+i][j], b)
+		}
+	}
+}
+
 func (s *TotalOrderingTestSuite) TestModeDefinition() {
 	// Make sure the copied deliver mode definition is identical between
 	// core and test package.
@@ -1434,3 +1787,83 @@ func (s *TotalOrderingTestSuite) TestModeDefinition() {
 func TestTotalOrdering(t *testing.T) {
 	suite.Run(t, new(TotalOrderingTestSuite))
 }
+
+// benchmarkTotalOrderingBlocks builds a randomly generated DAG workload with
+// numChains chains, revealed in random order. benchmarkProcessBlock builds
+// it once before the timer starts, so every b.N iteration of a benchmark
+// replays the same blocks; each benchmark builds its own workload.
+func benchmarkTotalOrderingBlocks(numChains uint32) []*types.Block {
+	gen := test.NewBlocksGenerator(&test.BlocksGeneratorConfig{
+		NumChains:            numChains,
+		MinBlockTimeInterval: 250 * time.Millisecond,
+	}, nil, hashBlock)
+	dbInst, err := db.NewMemBackedDB()
+	if err != nil {
+		panic(err)
+	}
+	genesisTime := time.Now().UTC()
+	if err := gen.Generate(
+		0, genesisTime, genesisTime.Add(20*time.Second), dbInst); err != nil {
+		panic(err)
+	}
+	iter, err := dbInst.GetAllBlocks()
+	if err != nil {
+		panic(err)
+	}
+	revealer, err := test.NewRandomDAGBlockRevealer(iter)
+	if err != nil {
+		panic(err)
+	}
+	var blocks []*types.Block
+	for {
+		b, err := revealer.NextBlock()
+		if err != nil {
+			if err == db.ErrIterationFinished {
+				break
+			}
+			panic(err)
+		}
+		b := b
+		blocks = append(blocks, &b)
+	}
+	return blocks
+}
+
+// benchmarkProcessBlock replays a 20-chain workload through processBlock
+// with refreshCandidates' internal parallelism fixed at parallelism, so
+// BenchmarkProcessBlockSerial (1) and BenchmarkProcessBlockParallel (8) can
+// be compared directly.
+func benchmarkProcessBlock(b *testing.B, parallelism int) {
+	numChains := uint32(20)
+	blocks := benchmarkTotalOrderingBlocks(numChains)
+	cfg := &types.Config{
+		RoundInterval: 1000 * time.Second,
+		K:             1,
+		PhiRatio:      0.5,
+		NumChains:     numChains,
+	}
+	genesisTime := time.Now().UTC()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		to := newTotalOrdering(genesisTime, 0, cfg)
+		to.SetParallelism(TotalOrderingConfig{Parallelism: parallelism})
+		for _, blk := range blocks {
+			if _, _, err := to.processBlock(blk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkProcessBlockSerial measures processBlock on a 20-chain workload
+// with refreshCandidates running its historical single-threaded passes.
+func BenchmarkProcessBlockSerial(b *testing.B) {
+	benchmarkProcessBlock(b, 1)
+}
+
+// BenchmarkProcessBlockParallel measures the same 20-chain workload with
+// refreshCandidates' per-chain passes sharded across a worker pool, to
+// demonstrate scaling against BenchmarkProcessBlockSerial.
+func BenchmarkProcessBlockParallel(b *testing.B) {
+	benchmarkProcessBlock(b, 8)
+}